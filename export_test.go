@@ -0,0 +1,21 @@
+package httpgzip
+
+import "sync"
+
+// resetPools drops writers kept in pools of c, so that tests do not depend on
+// state left by other tests. It must not be called concurrently with handlers
+// created from c.
+func resetPools(c *Config) {
+	for _, enc := range c.g.encodings {
+		resetPool(enc.pool)
+		for _, p := range enc.levelPools {
+			resetPool(p)
+		}
+	}
+}
+
+func resetPool(p *pool) {
+	if p.src == nil {
+		p.Pool = sync.Pool{New: p.Pool.New}
+	}
+}
@@ -3,15 +3,41 @@
 //
 // Content is compressed only if client understands it, content size is greater
 // than certain threshold and content type matches predefined list of types.
+// Besides gzip, handler can be configured to use "deflate" content-coding, see
+// WithEncodings.
+//
+// Compression decision is made when response is committed, which happens on
+// the first Write, or later if the body is buffered, see
+// WithMeasuredThreshold. Headers set by the wrapped handler after that, like
+// Content-Length, do not affect the decision.
+//
+// The package requires Go 1.21 or later.
 package httpgzip
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const compressThreshold = 1000
@@ -22,162 +48,2220 @@ const (
 	hdrContentType     = "Content-Type"
 	hdrContentLength   = "Content-Length"
 	hdrContentRange    = "Content-Range"
+	hdrAccelRedirect   = "X-Accel-Redirect"
+	hdrReprDigest      = "Repr-Digest"
+)
+
+// ErrWriteAfterClose is returned by Write calls made to the ResponseWriter
+// after the handler returned, i.e. by leaked goroutines.
+var ErrWriteAfterClose = errors.New("httpgzip: write after handler returned")
+
+// Option functions are used to configure new handler.
+type Option func(*gzipHandler)
+
+// Options returns a single Option applying all given options in order. This
+// allows distributing a set of options as a reusable preset.
+func Options(opts ...Option) Option {
+	return func(g *gzipHandler) {
+		for _, opt := range opts {
+			opt(g)
+		}
+	}
+}
+
+// WithLevel configures handler to use specified compression level. It will
+// panic if level is not one of the values accepted by gzip.NewWriterLevel.
+func WithLevel(level int) Option {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		panic(err)
+	}
+	return func(g *gzipHandler) {
+		g.level = level
+		g.used |= optLevel
+	}
+}
+
+// SetDefaultLevel changes compression level used by handlers configured
+// without WithLevel, which is gzip.BestSpeed initially. It affects the whole
+// process and only handlers created afterwards, so it should be called during
+// program initialization. It will panic if level is not one of the values
+// accepted by gzip.NewWriterLevel.
+func SetDefaultLevel(level int) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		panic(err)
+	}
+	atomic.StoreInt32(&defaultLevel, int32(level))
+	defaultConfig.Store(NewConfig())
+}
+
+var defaultLevel int32 = gzip.BestSpeed // accessed atomically
+
+// WithThreshold configures handler to only compress responses which body size
+// is at least n bytes, default is 1000. Size is taken from Content-Length
+// header set by wrapped handler, or measured if WithMeasuredThreshold is used.
+// It will panic if n is negative.
+func WithThreshold(n int) Option {
+	if n < 0 {
+		panic("httpgzip: WithThreshold called with negative n")
+	}
+	return func(g *gzipHandler) { g.threshold = n }
+}
+
+// WithCDNMode configures handler to use compression threshold of n bytes for
+// responses that can be cached by shared caches, if it is greater than the
+// regular one. Such responses have Cache-Control header with "public",
+// "max-age" or "s-maxage" directive, and without "private" or "no-store"
+// ones. This leaves compression of small cacheable responses to CDN, which
+// may use better content-codings, so that origin does less work. It will
+// panic if n is negative.
+func WithCDNMode(n int) Option {
+	if n < 0 {
+		panic("httpgzip: WithCDNMode called with negative n")
+	}
+	return func(g *gzipHandler) { g.cdnThreshold = n }
+}
+
+// WithEncodings configures handler to use given content-codings in the order
+// of server preference. Supported codings are "gzip" and "deflate", by default
+// only "gzip" is used. It will panic if given an unsupported coding or none at
+// all.
+func WithEncodings(names ...string) Option {
+	if len(names) == 0 {
+		panic("httpgzip: WithEncodings called without arguments")
+	}
+	cs := make([]*coding, len(names))
+	for i, name := range names {
+		c, ok := codings[strings.ToLower(name)]
+		if !ok {
+			panic(fmt.Sprintf("httpgzip: unsupported content-coding %q", name))
+		}
+		cs[i] = c
+	}
+	return func(g *gzipHandler) { g.codings = cs }
+}
+
+// WithContentEncodingToken configures handler to use token instead of "gzip"
+// as Content-Encoding header value of gzip compressed responses, for example
+// "x-gzip" for legacy clients. Body is still compressed in standard gzip
+// format. It will panic if token is empty.
+func WithContentEncodingToken(token string) Option {
+	if token == "" {
+		panic("httpgzip: WithContentEncodingToken called with empty token")
+	}
+	return func(g *gzipHandler) { g.gzipToken = token }
+}
+
+// WithAcceptEncodingHeader configures handler to also consult the named request
+// header if the standard Accept-Encoding header does not allow gzip. This is
+// useful behind reverse proxies that strip Accept-Encoding, but pass its
+// original value in a custom header like X-Forwarded-Accept-Encoding.
+func WithAcceptEncodingHeader(name string) Option {
+	name = http.CanonicalHeaderKey(name)
+	return func(g *gzipHandler) {
+		if name == hdrAcceptEncoding {
+			name = ""
+		}
+		g.aeHeader = name
+	}
+}
+
+// WithPredicate configures handler to only consider compressing responses to
+// requests for which fn returns true. Other requests are passed to the wrapped
+// handler as is, without any extra allocations, and without adding
+// "Vary: Accept-Encoding" header, so fn should only depend on request
+// properties that response already varies on, like URL path.
+func WithPredicate(fn func(*http.Request) bool) Option {
+	return func(g *gzipHandler) { g.predicate = fn }
+}
+
+// WithMeasuredThreshold configures handler to buffer response body until its
+// size reaches compression threshold before deciding whether to compress it.
+// This makes responses smaller than the threshold go uncompressed even if
+// handler does not set Content-Length header. Actual body size is
+// authoritative, Content-Length header set by handler is not used for this
+// decision. Calling Flush before the threshold is reached forces the decision,
+// in which case response is compressed if it otherwise qualifies.
+func WithMeasuredThreshold() Option {
+	return func(g *gzipHandler) { g.measured = true }
+}
+
+// WithSlowCompressionThreshold configures handler to call fn for each
+// response which compression took longer than d. Compression time is measured
+// from the moment handler decides to compress response until the wrapped
+// handler returns, fn is called with that duration, size of uncompressed body
+// and its content type.
+func WithSlowCompressionThreshold(d time.Duration, fn func(d time.Duration, size int64, contentType string)) Option {
+	return func(g *gzipHandler) {
+		g.slowThreshold = d
+		g.slowFn = fn
+	}
+}
+
+// WithMaxConcurrency configures handler to compress at most n responses at the
+// same time, responses over this limit are sent uncompressed. Packages
+// compress/gzip and compress/flate do not allow tuning window size or memory
+// level, and each compressing writer holds hundreds of kilobytes of internal
+// buffers, so limiting the number of writers in use is the way to bound
+// memory used for compression. Zero or negative n means no limit.
+func WithMaxConcurrency(n int) Option {
+	return func(g *gzipHandler) { g.maxConcurrency = n }
+}
+
+// WriterPool is a source of gzip writers, see WithWriterPool.
+type WriterPool interface {
+	Get() *gzip.Writer
+	Put(*gzip.Writer)
+}
+
+// WithWriterPool configures handler to get gzip writers from p instead of
+// its internal pool. Writers are Reset before use, so p may return writers
+// with any destination, but it is responsible for their compression level:
+// WithLevel, WithLevelByContentType and WithPrewarm do not apply to them.
+// This is mostly useful in tests, to make compression deterministic.
+func WithWriterPool(p WriterPool) Option {
+	return func(g *gzipHandler) {
+		g.writers = p
+		g.used |= optWriterPool
+	}
+}
+
+// WithPrewarm configures handler to allocate n compressing writers per
+// content-coding upfront, so that the first requests do not pay the cost of
+// their allocation, trading startup time and memory for steady latency under
+// a burst of requests on a cold start. Note that writers kept in pool may be
+// freed by garbage collector if they are not in use. It will panic if n is
+// negative.
+func WithPrewarm(n int) Option {
+	if n < 0 {
+		panic("httpgzip: WithPrewarm called with negative n")
+	}
+	return func(g *gzipHandler) { g.prewarm = n }
+}
+
+// WithVary configures handler to merge given values, together with
+// Accept-Encoding, into a single Vary header, removing duplicates. Values
+// already present in Vary header when handler is called come first, followed
+// by the given values in order, then Accept-Encoding.
+func WithVary(values ...string) Option {
+	return func(g *gzipHandler) { g.vary = append([]string(nil), values...) }
+}
+
+// WithVaryOnlyForTypes configures handler to add Vary header only to responses
+// of given media types, matched the same way as by WithContentTypes, instead
+// of all responses. If called without arguments, types that handler compresses
+// are used. This avoids fragmenting caches of static assets which are never
+// compressed, like images. As Content-Type is only known once the wrapped
+// handler starts writing the response, Vary header is added at that point.
+func WithVaryOnlyForTypes(types ...string) Option {
+	list := make([]string, 0, len(types))
+	for _, s := range types {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			list = append(list, s)
+		}
+	}
+	return func(g *gzipHandler) { g.varyTypes = list }
+}
+
+// WithContentTypes configures handler to only compress responses of given
+// media types instead of the built-in list. Each value matches media types it
+// is a prefix of, so that "text/" matches any text type, and
+// "application/json" also matches "application/json-seq". Values starting
+// with "+" match structured syntax suffix, so that "+json" matches
+// "application/ld+json". Matching is case-insensitive, media type parameters
+// are ignored.
+func WithContentTypes(types ...string) Option {
+	list := make([]string, 0, len(types))
+	for _, s := range types {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			list = append(list, s)
+		}
+	}
+	return func(g *gzipHandler) {
+		g.contentTypes = list
+		g.exactTypes = nil
+		g.used |= optContentTypes
+	}
+}
+
+// WithExactContentTypes configures handler to only compress responses of
+// given media types, matched exactly, case-insensitively, ignoring media type
+// parameters, instead of the built-in list. Unlike WithContentTypes, neither
+// prefixes nor structured syntax suffixes are matched. If both this option
+// and WithContentTypes are used, the last one takes effect.
+func WithExactContentTypes(types ...string) Option {
+	list := make([]string, 0, len(types))
+	for _, s := range types {
+		if s = mediaType(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return func(g *gzipHandler) {
+		g.exactTypes = list
+		g.contentTypes = nil
+		g.used |= optExactContentTypes
+	}
+}
+
+// DefaultContentTypes returns values in WithContentTypes format describing
+// media types that are compressed by default, so that they can be extended
+// with other types. The built-in matching is somewhat broader, as it compresses
+// any application type which subtype contains "json", "javascript",
+// "ecmascript" or "xml", see supportedContentType.
+func DefaultContentTypes() []string {
+	return []string{
+		"text/",
+		"image/svg+xml",
+		"application/json",
+		"application/javascript",
+		"application/x-javascript",
+		"application/ecmascript",
+		"application/xml",
+		"+json",
+		"+xml",
+	}
+}
+
+// WithErrorContext configures handler to record errors finalizing compressed
+// response in the request context, so that they can be retrieved with
+// CompressionError.
+func WithErrorContext() Option {
+	return func(g *gzipHandler) { g.errorContext = true }
+}
+
+// WithContextAwareWrites configures handler to check request context before
+// each write of the response body, so that once the client disconnects or the
+// context is otherwise canceled, Write returns context error. This stops
+// handlers streaming long responses early, without wasting CPU on compressing
+// data nobody reads, provided that they check Write errors.
+func WithContextAwareWrites() Option {
+	return func(g *gzipHandler) { g.ctxWrites = true }
+}
+
+// CompressionError returns error that occurred finalizing compressed response
+// to request with the context ctx. It only reports errors for handlers
+// configured with WithErrorContext, and is only meaningful after handler's
+// ServeHTTP method returned, so ctx has to be captured by the wrapped handler
+// and checked afterwards.
+func CompressionError(ctx context.Context) error {
+	if st, ok := ctx.Value(ctxKey{}).(*requestState); ok {
+		return st.err
+	}
+	return nil
+}
+
+type ctxKey struct{}
+
+// requestState is stored in request context to report compression results
+// back to the caller.
+type requestState struct {
+	err      error
+	encoding string // content-coding of response, see SelectedEncoding
+}
+
+// identity is the content-coding meaning no encoding.
+const identity = "identity"
+
+// WithEncodingContext configures handler to record content-coding of the
+// response in the request context, so that it can be retrieved with
+// SelectedEncoding, for example, by access logger wrapped by the handler.
+func WithEncodingContext() Option {
+	return func(g *gzipHandler) { g.encodingContext = true }
+}
+
+// SelectedEncoding returns content-coding of response to request with the
+// context ctx, as set in Content-Encoding header, or "identity" if response
+// is not compressed. It only reports encodings for handlers configured with
+// WithEncodingContext, and returns empty string otherwise. Compression
+// decision is made once the wrapped handler writes enough of the body, or
+// returns, so "identity" may be reported before that even if response ends up
+// compressed. Calling it after handler's ServeHTTP method returned always
+// gives the final result.
+func SelectedEncoding(ctx context.Context) string {
+	if st, ok := ctx.Value(ctxKey{}).(*requestState); ok {
+		return st.encoding
+	}
+	return ""
+}
+
+// WithUserAgentFilter configures handler to never compress responses to
+// clients which User-Agent fn returns true for. This allows disabling
+// compression for clients known to mishandle it. As such responses vary on
+// User-Agent header, consider adding it to Vary header with WithVary.
+func WithUserAgentFilter(fn func(ua string) bool) Option {
+	return func(g *gzipHandler) { g.uaFilter = fn }
+}
+
+// FlushPolicy controls whether Flush calls on ResponseWriter flush compressed
+// stream, see WithFlushPolicy.
+type FlushPolicy int
+
+const (
+	// FlushAlways flushes compressed stream on every Flush call.
+	FlushAlways FlushPolicy = 0
+	// FlushNever only flushes compressed stream when handler returns.
+	FlushNever FlushPolicy = -1
+)
+
+// FlushThreshold returns FlushPolicy that flushes compressed stream on Flush
+// call only if at least n bytes were written since the previous flush. It will
+// panic if n is not positive.
+func FlushThreshold(n int) FlushPolicy {
+	if n <= 0 {
+		panic("httpgzip: FlushThreshold called with non-positive n")
+	}
+	return FlushPolicy(n)
+}
+
+// WithWriteBufferSize configures handler to buffer up to n bytes of response
+// body before passing it to compressing writer, so that many small writes,
+// like ones made by JSON encoder, are coalesced into fewer larger ones. The
+// buffer is drained on Flush and when handler returns. Zero or negative n
+// means no buffering, which is the default.
+func WithWriteBufferSize(n int) Option {
+	return func(g *gzipHandler) { g.writeBufSize = n }
+}
+
+// WithInitialFlush configures handler to flush compressed response right after
+// sending its headers, before any body is compressed, so that client receives
+// compressed stream header immediately. This helps streaming clients that
+// decode response incrementally to start processing it earlier.
+func WithInitialFlush() Option {
+	return func(g *gzipHandler) { g.initialFlush = true }
+}
+
+// WithFlushPolicy configures how handler treats Flush calls on compressed
+// responses. Each flush of compressed stream costs a few bytes of output and
+// makes compression less effective, so streaming handlers that flush often
+// may trade latency for better compression ratio. Flush calls are always
+// propagated to the underlying ResponseWriter. Default is FlushAlways.
+func WithFlushPolicy(policy FlushPolicy) Option {
+	return func(g *gzipHandler) { g.flushPolicy = policy }
+}
+
+// ContentLengthPolicy controls whether compressed responses are sent with
+// Content-Length header, see WithContentLengthPolicy.
+type ContentLengthPolicy int
+
+const (
+	// DeleteAlways sends compressed responses without Content-Length, so
+	// they use chunked transfer encoding in HTTP/1.1.
+	DeleteAlways ContentLengthPolicy = iota
+	// PreserveIfBuffered sends compressed responses with Content-Length if
+	// the whole body was buffered before compression decision was made, see
+	// WithMeasuredThreshold and WithBufferHighWater. Such responses are
+	// compressed into memory before sending to learn their size.
+	PreserveIfBuffered
 )
 
-// Option functions are used to configure new handler.
-type Option func(*gzipHandler)
+// WithContentLengthPolicy configures whether compressed responses are sent
+// with Content-Length header. Default is DeleteAlways.
+func WithContentLengthPolicy(policy ContentLengthPolicy) Option {
+	return func(g *gzipHandler) { g.lengthPolicy = policy }
+}
+
+// WithContentTypeDetector configures handler to use fn instead of
+// http.DetectContentType to detect Content-Type of responses that do not have
+// it set. Function is called with up to 512 first bytes of response body, and
+// should return a valid Content-Type header value.
+func WithContentTypeDetector(fn func(firstBytes []byte) string) Option {
+	return func(g *gzipHandler) {
+		g.detector = fn
+		g.used |= optDetector
+	}
+}
+
+// WithoutContentTypeDetection configures handler to never detect Content-Type
+// of responses that do not have it set, and to send such responses
+// uncompressed, so that compression decision does not depend on body content.
+func WithoutContentTypeDetection() Option {
+	return func(g *gzipHandler) {
+		g.noDetection = true
+		g.used |= optNoDetection
+	}
+}
+
+// WithExtensionDetection configures handler to derive Content-Type of
+// responses that do not have it set from the extension of request URL path,
+// using mime.TypeByExtension, before falling back to detecting it from the
+// body. This helps with handlers serving files by path, which content may be
+// detected incorrectly. Extension is consulted even if handler is configured
+// with WithoutContentTypeDetection.
+func WithExtensionDetection() Option {
+	return func(g *gzipHandler) { g.extDetection = true }
+}
+
+// WithReflectionGuard configures handler to call fn before compressing
+// response, with the request and response headers, and to send response
+// uncompressed if fn returns true. Compression of responses which contain
+// both secrets, like CSRF tokens, and data reflected from request makes them
+// vulnerable to BREACH attack, which recovers secrets by observing compressed
+// response sizes. Function should report such responses.
+func WithReflectionGuard(fn func(*http.Request, http.Header) bool) Option {
+	return func(g *gzipHandler) { g.reflectionGuard = fn }
+}
+
+// WithSkipOnSetCookie configures handler to send responses that set cookies
+// uncompressed. Cookies often carry secrets, so this is a blunt mitigation of
+// BREACH attack, see WithReflectionGuard for a more precise one.
+func WithSkipOnSetCookie() Option {
+	return func(g *gzipHandler) { g.skipSetCookie = true }
+}
+
+// WithSkipRule configures handler to call fn before compressing response,
+// with its status code and headers, and to send response uncompressed if fn
+// returns true. This allows expressing arbitrary rules, that complement the
+// built-in ones: fn is not called for responses they already exclude.
+func WithSkipRule(fn func(status int, header http.Header) bool) Option {
+	return func(g *gzipHandler) { g.skipRule = fn }
+}
+
+// WithStrictChecks configures handler to panic if headers of compressed
+// response are inconsistent, either because of a bug in this package, or
+// because wrapped handler modified them after response was committed. This is
+// meant to catch bugs during development and should not be used in
+// production.
+func WithStrictChecks() Option {
+	return func(g *gzipHandler) { g.strict = true }
+}
+
+// WithCompressStatusClasses configures handler to only compress responses
+// which status code belongs to one of the given classes, where class is the
+// first digit of the status code: 2 for 2xx, 3 for 3xx, and so on. Responses
+// with 204, 206 and 304 status codes are never compressed. By default,
+// responses of all classes except 3xx are compressed, as bodies of redirects
+// are informational. It will panic if class is not in the range from 2 to 5.
+func WithCompressStatusClasses(classes ...int) Option {
+	var mask uint8
+	for _, c := range classes {
+		if c < 2 || c > 5 {
+			panic(fmt.Sprintf("httpgzip: invalid status class %d", c))
+		}
+		mask |= 1 << c
+	}
+	return func(g *gzipHandler) { g.statusClasses = mask }
+}
+
+// WithEntropyGuard configures handler to skip compression of responses which
+// first bytes look like random data: Shannon entropy of up to 512 first bytes
+// of response body is estimated, and if it exceeds maxBitsPerByte, response is
+// not compressed. This complements content type checks for types which
+// content may or may not be compressible. Already compressed or encrypted data
+// usually has entropy close to 8 bits per byte, while text rarely exceeds 5.
+// It will panic if maxBitsPerByte is not in (0, 8] range.
+func WithEntropyGuard(maxBitsPerByte float64) Option {
+	if !(maxBitsPerByte > 0 && maxBitsPerByte <= 8) {
+		panic("httpgzip: WithEntropyGuard argument must be in (0, 8] range")
+	}
+	return func(g *gzipHandler) { g.maxEntropy = maxBitsPerByte }
+}
+
+// WithBufferHighWater configures handler to buffer up to n bytes of response
+// body before deciding whether to compress it, instead of buffering only up to
+// compression threshold. It implies WithMeasuredThreshold. If response body
+// ends before n bytes are written, it is compressed if its size reaches
+// compression threshold, and response that reaches n bytes is compressed as
+// it is streamed. Larger buffer allows deciding based on the actual size for
+// more responses at the cost of memory and latency. Values below compression
+// threshold are treated as equal to it.
+func WithBufferHighWater(n int) Option {
+	return func(g *gzipHandler) {
+		g.measured = true
+		g.highWater = n
+	}
+}
+
+// WithHeaderHook configures handler to call fn right before response status
+// and headers are sent, after compression decision is made and headers are
+// updated accordingly. Function may modify headers, compressed reports whether
+// response is compressed.
+func WithHeaderHook(fn func(h http.Header, compressed bool)) Option {
+	return func(g *gzipHandler) { g.headerHook = fn }
+}
+
+// WithLevelByContentType configures handler to use compression level
+// depending on response content type. Keys of m are media types or their
+// prefixes, like "text/html" or "application/", matched case-insensitively
+// against Content-Type without parameters, the longest matching key wins.
+// Responses of types not matching any key use level set with WithLevel, or the
+// default one. This allows, for example, using gzip.BestCompression for HTML
+// while keeping gzip.BestSpeed for JSON. It will panic if any of the levels is
+// not one of the values accepted by gzip.NewWriterLevel.
+func WithLevelByContentType(m map[string]int) Option {
+	for _, level := range m {
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			panic(err)
+		}
+	}
+	list := newTypeValues(m)
+	return func(g *gzipHandler) {
+		g.typeLevels = list
+		g.used |= optLevelByContentType
+	}
+}
+
+// WithLevelProvider configures handler to call fn each time it starts
+// compressing a response, to get compression level to use instead of the one
+// set with WithLevel. This allows external load monitor to dial compression
+// down under CPU pressure. Levels set with WithLevelByContentType take
+// precedence. If fn returns a value not accepted by gzip.NewWriterLevel, the
+// level set with WithLevel, or the default one, is used.
+func WithLevelProvider(fn func() int) Option {
+	return func(g *gzipHandler) {
+		g.levelProvider = fn
+		g.used |= optLevelProvider
+	}
+}
+
+// WithThresholdPerType configures handler to use compression threshold
+// depending on response content type, instead of the one set with
+// WithThreshold. Keys of m are matched the same way as by
+// WithLevelByContentType. This allows, for example, compressing small JSON
+// responses while keeping the default threshold for other types. It will
+// panic if any of the thresholds is negative.
+func WithThresholdPerType(m map[string]int) Option {
+	for _, n := range m {
+		if n < 0 {
+			panic("httpgzip: WithThresholdPerType called with negative threshold")
+		}
+	}
+	list := newTypeValues(m)
+	return func(g *gzipHandler) { g.typeThresholds = list }
+}
+
+// WithAlwaysCompressTypes configures handler to compress responses of given
+// media types regardless of their size, ignoring compression threshold. Types
+// are matched the same way as by WithContentTypes. Responses still have to be
+// of compressible type, see WithContentTypes.
+func WithAlwaysCompressTypes(types ...string) Option {
+	list := make([]string, 0, len(types))
+	for _, s := range types {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			list = append(list, s)
+		}
+	}
+	return func(g *gzipHandler) { g.alwaysTypes = list }
+}
+
+// typeValue is a setting value to use for media types with given prefix.
+type typeValue struct {
+	prefix string
+	value  int
+}
+
+// newTypeValues returns list of values for media type prefixes from m, sorted
+// by prefix length, longest first.
+func newTypeValues(m map[string]int) []typeValue {
+	list := make([]typeValue, 0, len(m))
+	for k, v := range m {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			list = append(list, typeValue{prefix: k, value: v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return len(list[i].prefix) > len(list[j].prefix) })
+	return list
+}
+
+// lookupType returns value from list for the longest prefix of media type of
+// Content-Type header value ct.
+func lookupType(list []typeValue, ct string) (int, bool) {
+	if len(list) == 0 {
+		return 0, false
+	}
+	ct = mediaType(ct)
+	for _, tv := range list {
+		if strings.HasPrefix(ct, tv.prefix) {
+			return tv.value, true
+		}
+	}
+	return 0, false
+}
+
+// WithProxyHandoffHeader configures handler to never compress responses
+// which have the named header set, instead of the default X-Accel-Redirect.
+// Such responses delegate sending the body to the reverse proxy, like nginx
+// does for X-Accel-Redirect, so setting Content-Encoding on them is
+// meaningless. Empty name disables this check.
+func WithProxyHandoffHeader(name string) Option {
+	if name != "" {
+		name = http.CanonicalHeaderKey(name)
+	}
+	return func(g *gzipHandler) { g.proxyHandoff = name }
+}
+
+// WithReprDigest configures handler to set Repr-Digest header with SHA-256
+// digest of compressed response body, see RFC 9530. As digest is only known
+// once the whole body is compressed, compressed responses are buffered in
+// memory until handler returns, and are sent with Content-Length header. Flush
+// calls have no effect on such responses. Uncompressed responses are sent as
+// is, without Repr-Digest header.
+func WithReprDigest() Option {
+	return func(g *gzipHandler) { g.reprDigest = true }
+}
+
+// WithGzipCommentHeader configures handler to remove the named header from
+// responses, and if response is compressed with gzip, to use its value as
+// the comment field of gzip header. Values which are not valid comments, i.e.
+// contain characters outside of ISO 8859-1 or zero bytes, are ignored.
+func WithGzipCommentHeader(name string) Option {
+	name = http.CanonicalHeaderKey(name)
+	return func(g *gzipHandler) { g.commentHeader = name }
+}
+
+// WithHintHeader configures handler to respect compression hint which the
+// wrapped handler, like a proxy knowing whether upstream payload is worth
+// compressing, sets in the named response header. Value "no" makes response
+// sent uncompressed, value "yes" makes it compressed regardless of its content
+// type, while other checks, like the size threshold, still apply. Values are
+// case-insensitive, responses without hint are handled as usual. The header is
+// removed from responses.
+func WithHintHeader(name string) Option {
+	name = http.CanonicalHeaderKey(name)
+	return func(g *gzipHandler) { g.hintHeader = name }
+}
+
+// WithHeadPrecompute configures handler to send responses to HEAD requests
+// with Content-Length header equal to the size of compressed body of the
+// equivalent GET response. To find it, body written by the wrapped handler is
+// compressed and discarded, so HEAD requests cost as much CPU as GET ones,
+// and headers are only sent once handler returns. This only works for
+// handlers writing the same body for HEAD requests as for GET ones, which
+// net/http permits. Handlers writing no body for HEAD requests, which include
+// http.ServeContent, http.ServeFile and http.FileServer, get no benefit from
+// it: such responses are sent without Content-Length, as they are without
+// this option.
+func WithHeadPrecompute() Option {
+	return func(g *gzipHandler) { g.headPrecompute = true }
+}
+
+// WithHTTP10Buffering configures handler to buffer response bodies to
+// HTTP/1.0 requests up to max bytes, so that compressed response can be sent
+// with Content-Length header. HTTP/1.0 does not support chunked transfer
+// coding, so otherwise server has to close connection to delimit compressed
+// body. Bodies larger than max, and responses flushed by handler before it
+// returns, are sent uncompressed. It will panic if max is not positive.
+func WithHTTP10Buffering(max int) Option {
+	if max <= 0 {
+		panic("httpgzip: WithHTTP10Buffering called with non-positive max")
+	}
+	return func(g *gzipHandler) { g.http10Max = max }
+}
+
+// WithObserver configures handler to call fn with statistics of each response
+// to request that accepts one of the configured content-codings, once the
+// wrapped handler returns.
+func WithObserver(fn func(CompressionStats)) Option {
+	return func(g *gzipHandler) { g.observer = fn }
+}
+
+// WithLogger configures handler to log compression decision for each response
+// to request that accepts one of the configured content-codings at debug
+// level, and errors finalizing compressed responses at warning level. Records
+// have attributes "encoding", "content_type", "skipped", "reason", "bytes_in"
+// and "bytes_out", see CompressionStats for their meaning.
+func WithLogger(l *slog.Logger) Option {
+	return func(g *gzipHandler) { g.logger = l }
+}
+
+// CompressionStats describes a single response, see WithObserver.
+type CompressionStats struct {
+	BytesIn  int64  // body bytes accepted from the wrapped handler
+	BytesOut int64  // body bytes written to the underlying ResponseWriter
+	Encoding string // content-coding used, empty if response was not compressed
+
+	// ContentType is the Content-Type of response, either set by the wrapped
+	// handler, or detected from the body, in which case Sniffed is true.
+	// This allows finding responses which type was detected incorrectly.
+	ContentType string
+	Sniffed     bool
+
+	// TTFBDelay is time from the first write of the body by the wrapped
+	// handler to the first write to the underlying ResponseWriter, which
+	// shows how much buffering delayed the first byte of the response. It is
+	// zero if response has no body. See WithInitialFlush.
+	TTFBDelay time.Duration
+}
+
+// WithHonorPreference configures handler to only compress response if client
+// gives content-coding quality value strictly greater than the one it gives to
+// "identity" coding, if it lists it in Accept-Encoding header. By default
+// response is compressed whenever client accepts content-coding, so that
+// "identity;q=1.0, gzip;q=0.5" gets compressed response.
+func WithHonorPreference() Option {
+	return func(g *gzipHandler) { g.honorPreference = true }
+}
+
+// WithSampleRate configures handler to compress only given fraction of
+// responses to requests that accept compression, chosen randomly, sending
+// other responses uncompressed. This allows shedding CPU load spent on
+// compression. Default rate is 1, which compresses all eligible responses. It
+// will panic if fraction is not in [0, 1] range.
+func WithSampleRate(fraction float64) Option {
+	if !(fraction >= 0 && fraction <= 1) {
+		panic("httpgzip: WithSampleRate argument must be in [0, 1] range")
+	}
+	return func(g *gzipHandler) { g.sampleRate = fraction }
+}
+
+// WithMinQuality configures handler to only compress response if client gives
+// content-coding quality value of at least q in Accept-Encoding header, so
+// that clients which merely tolerate compression, like "gzip;q=0.1", get
+// uncompressed response. It will panic if q is not in (0, 1] range.
+func WithMinQuality(q float64) Option {
+	if !(q > 0 && q <= 1) {
+		panic("httpgzip: WithMinQuality argument must be in (0, 1] range")
+	}
+	return func(g *gzipHandler) { g.minQuality = q }
+}
+
+// Inspector is implemented by handlers returned by New and NewWithConfig,
+// allowing to inspect their effective configuration.
+type Inspector interface {
+	Level() int     // compression level
+	Threshold() int // min size of response body to compress
+}
+
+// New returns a http.Handler that optionally compresses response using
+// 'Content-Enconding: gzip' scheme.
+func New(h http.Handler, options ...Option) http.Handler {
+	return NewWithConfig(h, NewConfig(options...))
+}
+
+// NewChecked is like New, but returns an error if options conflict with each
+// other, instead of letting the last one take effect.
+func NewChecked(h http.Handler, options ...Option) (http.Handler, error) {
+	var g gzipHandler
+	for _, fn := range options {
+		fn(&g)
+	}
+	for _, c := range optionConflicts {
+		if g.used&c[0] != 0 && g.used&c[1] != 0 {
+			return nil, fmt.Errorf("httpgzip: conflicting options %s and %s", optionNames[c[0]], optionNames[c[1]])
+		}
+	}
+	return New(h, options...), nil
+}
+
+// optionSet is a bit mask of options that can conflict with each other.
+type optionSet uint
+
+const (
+	optLevel optionSet = 1 << iota
+	optLevelByContentType
+	optWriterPool
+	optContentTypes
+	optExactContentTypes
+	optDetector
+	optNoDetection
+	optLevelProvider
+)
+
+var optionNames = map[optionSet]string{
+	optLevel:              "WithLevel",
+	optLevelByContentType: "WithLevelByContentType",
+	optWriterPool:         "WithWriterPool",
+	optContentTypes:       "WithContentTypes",
+	optExactContentTypes:  "WithExactContentTypes",
+	optDetector:           "WithContentTypeDetector",
+	optNoDetection:        "WithoutContentTypeDetection",
+	optLevelProvider:      "WithLevelProvider",
+}
+
+var optionConflicts = [...][2]optionSet{
+	{optWriterPool, optLevel},
+	{optWriterPool, optLevelByContentType},
+	{optWriterPool, optLevelProvider},
+	{optContentTypes, optExactContentTypes},
+	{optDetector, optNoDetection},
+}
+
+// Config is a reusable handler configuration. Handlers created from the same
+// Config share their settings and compressing writers pools.
+type Config struct {
+	g gzipHandler
+}
+
+// NewConfig returns Config with given options applied.
+func NewConfig(options ...Option) *Config {
+	c := &Config{g: gzipHandler{
+		level:        int(atomic.LoadInt32(&defaultLevel)),
+		threshold:    compressThreshold,
+		sampleRate:   1,
+		codings:      []*coding{codingGzip},
+		proxyHandoff: hdrAccelRedirect,
+	}}
+	for _, fn := range options {
+		fn(&c.g)
+	}
+	c.g.encodings = make([]encoding, len(c.g.codings))
+	for i, cd := range c.g.codings {
+		token := cd.name
+		if cd == codingGzip && c.g.gzipToken != "" {
+			token = c.g.gzipToken
+		}
+		if cd == codingGzip && c.g.writers != nil {
+			c.g.encodings[i] = encoding{name: cd.name, token: token, pool: &pool{src: c.g.writers}}
+			continue
+		}
+		enc := encoding{name: cd.name, token: token, pool: newWriterPool(cd, c.g.level)}
+		if c.g.levelProvider != nil {
+			enc.coding, enc.dynPools = cd, new(sync.Map)
+		}
+		for j := 0; j < c.g.prewarm; j++ {
+			enc.pool.Put(enc.pool.New().(encoder))
+		}
+		for _, tv := range c.g.typeLevels {
+			if tv.value == c.g.level {
+				continue
+			}
+			if enc.levelPools == nil {
+				enc.levelPools = make(map[int]*pool)
+			}
+			if enc.levelPools[tv.value] == nil {
+				enc.levelPools[tv.value] = newWriterPool(cd, tv.value)
+			}
+		}
+		c.g.encodings[i] = enc
+	}
+	if len(c.g.vary) != 0 {
+		c.g.vary = append(c.g.vary, hdrAcceptEncoding)
+		if c.g.aeHeader != "" {
+			c.g.vary = append(c.g.vary, c.g.aeHeader)
+		}
+	}
+	if c.g.highWater < c.g.threshold {
+		c.g.highWater = c.g.threshold
+	}
+	for _, tv := range c.g.typeThresholds {
+		if c.g.highWater < tv.value {
+			c.g.highWater = tv.value
+		}
+	}
+	if c.g.highWater < c.g.cdnThreshold {
+		c.g.highWater = c.g.cdnThreshold
+	}
+	if c.g.maxConcurrency > 0 {
+		c.g.sem = make(chan struct{}, c.g.maxConcurrency)
+	}
+	c.g.aeCache = new(aeCache)
+	if n := c.g.writeBufSize; n > 0 {
+		c.g.bufPool = &sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, n) }}
+	}
+	return c
+}
+
+// NewWithConfig returns a http.Handler that optionally compresses response
+// using 'Content-Enconding: gzip' scheme, configured by c. It is safe to create
+// multiple handlers from the same Config.
+func NewWithConfig(h http.Handler, c *Config) http.Handler {
+	g := c.g
+	g.h = h
+	return &g
+}
+
+// CompressBytes returns data compressed with the first content-coding
+// configured by options, which is gzip by default, at the configured level.
+// When called without options it reuses compressing writers pool of the
+// default configuration, otherwise pool is created for each call.
+func CompressBytes(data []byte, options ...Option) ([]byte, error) {
+	c := baseConfig()
+	if len(options) != 0 {
+		c = NewConfig(options...)
+	}
+	var buf bytes.Buffer
+	p := c.g.encodings[0].pool
+	z := p.Get()
+	defer p.Put(z)
+	z.Reset(&buf)
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// defaultConfig is configuration without options, rebuilt by SetDefaultLevel.
+var defaultConfig atomic.Pointer[Config]
+
+func init() { defaultConfig.Store(NewConfig()) }
+
+// baseConfig returns default configuration.
+func baseConfig() *Config { return defaultConfig.Load() }
+
+// NewRouter returns a http.Handler that compresses responses of h using
+// configuration selected by request URL path. Keys of routes are patterns:
+// the ones ending with a slash match paths they are prefix of, others match
+// paths exactly, the longest matching pattern wins, as with http.ServeMux.
+// Requests not matching any pattern use fallback configuration, or are passed
+// to h as is if fallback is nil. The same way requests matching pattern with
+// nil configuration are passed to h as is, which allows excluding some paths
+// from compression.
+func NewRouter(h http.Handler, routes map[string]*Config, fallback *Config) http.Handler {
+	rt := &router{fallback: h}
+	if fallback != nil {
+		rt.fallback = NewWithConfig(h, fallback)
+	}
+	for pattern, c := range routes {
+		rh := h
+		if c != nil {
+			rh = NewWithConfig(h, c)
+		}
+		rt.routes = append(rt.routes, route{pattern: pattern, h: rh})
+	}
+	sort.Slice(rt.routes, func(i, j int) bool { return len(rt.routes[i].pattern) > len(rt.routes[j].pattern) })
+	return rt
+}
+
+type router struct {
+	routes   []route // sorted by pattern length, longest first
+	fallback http.Handler
+}
+
+type route struct {
+	pattern string
+	h       http.Handler
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	for _, route := range rt.routes {
+		if p == route.pattern || strings.HasSuffix(route.pattern, "/") && strings.HasPrefix(p, route.pattern) {
+			route.h.ServeHTTP(w, r)
+			return
+		}
+	}
+	rt.fallback.ServeHTTP(w, r)
+}
+
+type gzipHandler struct {
+	h          http.Handler
+	level      int
+	threshold  int         // min size of body to compress
+	typeLevels []typeValue // levels by content type
+	codings    []*coding   // configured codings in the order of preference
+	encodings  []encoding  // writer pools for codings, built from level and codings
+	aeHeader   string      // optional extra header to check in addition to Accept-Encoding
+	gzipToken  string      // if set, Content-Encoding value to use for gzip
+	predicate  func(*http.Request) bool
+	uaFilter   func(string) bool
+	vary       []string // if set, values to merge into Vary header
+	measured   bool     // whether to buffer body until its size reaches threshold
+	highWater  int      // how much of body to buffer in measured mode
+
+	honorPreference bool     // whether to respect identity coding preference
+	aeCache         *aeCache // shared by handlers created from the same Config
+	sampleRate      float64  // fraction of eligible responses to compress
+	minQuality      float64  // min quality value of coding to use it
+	reflectionGuard func(*http.Request, http.Header) bool
+	levelProvider   func() int // if set, provides level per response
+	encodingContext bool       // whether to record encoding in requestState
+	skipSetCookie   bool       // whether to skip responses setting cookies
+	skipRule        func(int, http.Header) bool
+	headPrecompute  bool     // whether to compute compressed size for HEAD requests
+	commentHeader   string   // header to take gzip comment from
+	hintHeader      string   // header with compression hint from handler
+	varyTypes       []string // if not nil, types of responses to add Vary to
+
+	contentTypes []string // if not nil, overrides supportedContentType
+	exactTypes   []string // if not nil, overrides supportedContentType and contentTypes
+	errorContext bool     // whether to store requestState in request context
+	flushPolicy  FlushPolicy
+	lengthPolicy ContentLengthPolicy
+	initialFlush bool
+	ctxWrites    bool // whether Write checks request context
+	writeBufSize int
+	bufPool      *sync.Pool          // pool of *bufio.Writer of writeBufSize size
+	detector     func([]byte) string // if set, used instead of http.DetectContentType
+	noDetection  bool                // whether to skip responses without Content-Type
+	extDetection bool                // whether to derive Content-Type from URL path
+	strict       bool                // whether to call gRW.checkHeaders
+	headerHook   func(http.Header, bool)
+	proxyHandoff string // header which presence means proxy sends the body
+	reprDigest   bool   // whether to buffer compressed body to set Repr-Digest
+	observer     func(CompressionStats)
+	logger       *slog.Logger
+	http10Max    int // if positive, max body size to buffer for HTTP/1.0 requests
+
+	statusClasses  uint8       // bit mask of status classes to compress, 0 means all
+	maxEntropy     float64     // if positive, max entropy of body to compress
+	typeThresholds []typeValue // thresholds by content type
+	alwaysTypes    []string    // types to compress regardless of threshold
+	cdnThreshold   int         // if positive, threshold for cacheable responses
+
+	maxConcurrency int
+	prewarm        int
+	writers        WriterPool    // if set, used instead of internal pool of gzip writers
+	sem            chan struct{} // limits number of concurrently used writers
+
+	slowThreshold time.Duration
+	slowFn        func(d time.Duration, size int64, contentType string)
+
+	used optionSet // options that can conflict, see NewChecked
+}
+
+// Level implements Inspector.
+func (h *gzipHandler) Level() int { return h.level }
+
+// Threshold implements Inspector.
+func (h *gzipHandler) Threshold() int { return h.threshold }
+
+// encoding is a content-coding with a pool of writers configured for the
+// handler.
+type encoding struct {
+	name       string
+	token      string // Content-Encoding header value
+	pool       *pool
+	levelPools map[int]*pool // pools for levels set by WithLevelByContentType
+
+	// if WithLevelProvider is used, pools for levels it returns, created on
+	// demand, keyed by level
+	coding   *coding
+	dynPools *sync.Map
+}
+
+// writerPool returns pool of writers to use for content of the given type.
+func (h *gzipHandler) writerPool(enc *encoding, ct string) *pool {
+	if level, ok := lookupType(h.typeLevels, ct); ok {
+		if p := enc.levelPools[level]; p != nil {
+			return p
+		}
+		if level == h.level {
+			return enc.pool
+		}
+	}
+	if enc.dynPools != nil {
+		if level := h.levelProvider(); level != h.level && level >= gzip.HuffmanOnly && level <= gzip.BestCompression {
+			if p, ok := enc.dynPools.Load(level); ok {
+				return p.(*pool)
+			}
+			p, _ := enc.dynPools.LoadOrStore(level, newWriterPool(enc.coding, level))
+			return p.(*pool)
+		}
+	}
+	return enc.pool
+}
+
+// compressibleStatus reports whether response with the given status code may
+// be compressed.
+func (h *gzipHandler) compressibleStatus(code int) bool {
+	switch code {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if m := h.statusClasses; m == 0 && code/100 == 3 ||
+		m != 0 && (code < 200 || code > 599 || m&(1<<(code/100)) == 0) {
+		return false
+	}
+	return true
+}
+
+// thresholdFor returns compression threshold for content of the given type.
+func (h *gzipHandler) thresholdFor(ct string) int {
+	if n, ok := lookupType(h.typeThresholds, ct); ok {
+		return n
+	}
+	return h.threshold
+}
+
+func (h *gzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if w == nil || h.predicate != nil && !h.predicate(r) {
+		h.passThrough(w, r)
+		return
+	}
+	if h.varyTypes == nil {
+		h.addVary(w.Header())
+	}
+	enc := h.negotiate(r)
+	switch {
+	case enc == nil:
+		h.serveIdentity(w, r, nil, "not accepted")
+		return
+	case h.uaFilter != nil && h.uaFilter(r.UserAgent()):
+		h.serveIdentity(w, r, enc, "user agent")
+		return
+	case h.sampleRate < 1 && rand.Float64() >= h.sampleRate:
+		h.serveIdentity(w, r, enc, "sample rate")
+		return
+	}
+	z := &gRW{w: w, h: h, enc: enc}
+	z.http10 = h.http10Max > 0 && r.ProtoMajor == 1 && r.ProtoMinor == 0
+	z.headOnly = r.Method == http.MethodHead
+	if h.errorContext || h.encodingContext {
+		z.state = &requestState{encoding: identity}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, z.state))
+	}
+	if h.reflectionGuard != nil || h.extDetection || h.logger != nil {
+		z.r = r
+	}
+	if h.ctxWrites {
+		z.ctx = r.Context()
+	}
+	defer z.close()
+	h.h.ServeHTTP(z, r)
+}
+
+// addVary adds values to Vary header of responses which may be compressed.
+func (h *gzipHandler) addVary(hdr http.Header) {
+	if len(h.vary) != 0 {
+		mergeVary(hdr, h.vary)
+		return
+	}
+	hdr.Add("Vary", hdrAcceptEncoding)
+	if h.aeHeader != "" {
+		hdr.Add("Vary", h.aeHeader)
+	}
+}
+
+// serveIdentity serves request which response is not compressed for the given
+// reason, delaying adding Vary header until response type is known, removing
+// hint header and reporting response to observer and logger, if needed. If enc
+// is nil, request accepts none of the configured encodings.
+func (h *gzipHandler) serveIdentity(w http.ResponseWriter, r *http.Request, enc *encoding, reason string) {
+	observed := enc != nil && (h.observer != nil || h.logger != nil)
+	if h.varyTypes == nil && h.hintHeader == "" && !observed {
+		h.passThrough(w, r)
+		return
+	}
+	z := &gRW{w: w, h: h, enc: enc, skip: true, reason: reason}
+	if h.logger != nil {
+		z.r = r
+	}
+	defer z.close()
+	h.passThrough(z, r)
+}
+
+// passThrough serves request with the wrapped handler without compression.
+func (h *gzipHandler) passThrough(w http.ResponseWriter, r *http.Request) {
+	if h.encodingContext {
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, &requestState{encoding: identity}))
+	}
+	h.h.ServeHTTP(w, r)
+}
+
+// mergeVary replaces Vary header values with a single value listing existing
+// values followed by given ones, with case-insensitive duplicates removed.
+func mergeVary(hdr http.Header, values []string) {
+	var out []string
+	add := func(v string) {
+		if v = strings.TrimSpace(v); v == "" {
+			return
+		}
+		for _, s := range out {
+			if strings.EqualFold(s, v) {
+				return
+			}
+		}
+		out = append(out, v)
+	}
+	for _, line := range hdr.Values("Vary") {
+		for _, v := range strings.Split(line, ",") {
+			add(v)
+		}
+	}
+	for _, v := range values {
+		add(v)
+	}
+	hdr.Set("Vary", strings.Join(out, ", "))
+}
+
+type gRW struct {
+	// mu serializes writes with close, as handler may leave goroutines
+	// writing to response after it returns
+	mu sync.Mutex
+
+	w           http.ResponseWriter
+	z           encoder
+	bw          *bufio.Writer // if set, coalesces writes to z
+	pool        *pool         // pool z was taken from
+	h           *gzipHandler
+	enc         *encoding       // selected content-coding
+	r           *http.Request   // only set if needed by options
+	ctx         context.Context // only set if writes check request context
+	state       *requestState
+	buf         []byte        // body buffered while measuring its size
+	out         *bytes.Buffer // if not nil, compressed body buffered until close
+	code        int           // status code passed to WriteHeader
+	skip        bool
+	wroteHeader bool // whether WriteHeader was called
+	committed   bool // whether status code was sent to w
+	closed      bool // whether handler returned
+	http10      bool // whether to buffer whole body for HTTP/1.0 request
+	headOnly    bool // whether request is HEAD, so body is not sent
+	sniffed     bool // whether Content-Type was detected from body
+
+	started   time.Time // when compression started, only set if needed
+	size      int64     // number of body bytes accepted from handler
+	written   int64     // number of body bytes written to w, counted for observer
+	unflushed int64     // number of bytes passed to z since its last flush
+	discarded int64     // compressed size of body to HEAD request, see WithHeadPrecompute
+	reason    string    // why response is not compressed, for logging
+	firstIn   time.Time // time of the first write by handler, set for observer
+	firstOut  time.Time // time of the first write to w, set for observer
+}
+
+// skipFor marks response to be sent uncompressed for the given reason, unless
+// it already is.
+func (g *gRW) skipFor(reason string) {
+	if !g.skip {
+		g.skip, g.reason = true, reason
+	}
+}
+
+// init decides whether to compress response based on its headers and head,
+// which is up to 512 first bytes of the body, and sets up compression.
+func (g *gRW) init(head []byte) {
+	if g.skip || g.z != nil {
+		return
+	}
+	if g.w == nil {
+		g.skipFor("no writer") // misuse, there is nothing to compress into
+		return
+	}
+	if reason := g.rejection(g.code, head); reason != "" {
+		g.skipFor(reason)
+		return
+	}
+	ct := g.w.Header().Get(hdrContentType)
+	if g.headOnly && !g.h.headPrecompute {
+		// body of response to HEAD request is not sent, so headers are set
+		// as for GET request, but there is nothing to compress
+		g.z = discardEncoder{}
+	} else if !g.startEncoder(ct) {
+		g.skipFor("concurrency limit")
+		return
+	}
+	g.w.Header().Set(hdrContentEncoding, g.enc.token)
+	g.w.Header().Del(hdrContentLength)
+	if g.state != nil {
+		g.state.encoding = g.enc.token
+	}
+	if ct != "" && len(g.w.Header().Values(hdrContentType)) > 1 {
+		g.w.Header().Set(hdrContentType, ct)
+	}
+}
+
+// rejection returns the reason why response with the given status code and
+// head of the body should not be compressed, judging by its headers and head,
+// or empty string if it may be compressed.
+func (g *gRW) rejection(code int, head []byte) string {
+	hdr := g.w.Header()
+	switch {
+	case hdr.Get(hdrContentRange) != "":
+		return "content range"
+	case hdr.Get(hdrContentEncoding) != "":
+		return "already encoded"
+	case g.h.proxyHandoff != "" && hdr.Get(g.h.proxyHandoff) != "":
+		return "proxy handoff"
+	case g.h.skipSetCookie && len(hdr.Values("Set-Cookie")) != 0:
+		return "set-cookie"
+	}
+	var hint string
+	if g.h.hintHeader != "" {
+		hint = strings.ToLower(strings.TrimSpace(hdr.Get(g.h.hintHeader)))
+	}
+	if hint == "no" {
+		return "hint"
+	}
+	// If handler set multiple Content-Type values, only the first one is
+	// considered, same as net/http does when deciding whether to sniff it.
+	ct := hdr.Get(hdrContentType)
+	if cl := hdr.Get(hdrContentLength); cl != "" && !g.h.measured {
+		if n, err := strconv.Atoi(cl); err == nil && n < g.threshold() {
+			return "below threshold"
+		}
+	}
+	switch {
+	case hint != "yes" && (ct == "" && g.h.noDetection || ct != "" && !g.h.compressible(ct)):
+		return "content type"
+	case g.h.reflectionGuard != nil && g.r != nil && g.h.reflectionGuard(g.r, hdr):
+		return "reflection guard"
+	case g.h.maxEntropy > 0 && len(head) != 0 && entropy(head) > g.h.maxEntropy:
+		return "high entropy"
+	case g.h.skipRule != nil && g.h.skipRule(code, hdr):
+		return "skip rule"
+	}
+	return ""
+}
+
+// startEncoder sets up compressing writer for content of the given type. It
+// returns false if concurrency limit is reached.
+func (g *gRW) startEncoder(ct string) bool {
+	if g.h.sem != nil {
+		select {
+		case g.h.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if g.h.slowFn != nil {
+		g.started = time.Now()
+	}
+	g.pool = g.h.writerPool(g.enc, ct)
+	g.z = g.pool.Get()
+	if g.h.bufPool != nil {
+		g.bw = g.h.bufPool.Get().(*bufio.Writer)
+		g.bw.Reset(g.z)
+	}
+	if g.h.reprDigest || g.http10 || g.closed && g.h.lengthPolicy == PreserveIfBuffered {
+		g.out = new(bytes.Buffer)
+		g.z.Reset(g.out)
+	} else if g.headOnly {
+		// body is not sent, only its size is needed, so out stays empty
+		g.out = new(bytes.Buffer)
+		g.z.Reset(discardCounter{&g.discarded})
+	} else if g.h.observer != nil || g.h.logger != nil {
+		g.z.Reset(countingWriter{g})
+	} else {
+		g.z.Reset(g.w)
+	}
+	return true
+}
+
+func (g *gRW) Header() http.Header { return g.w.Header() }
+
+// WriteHeader records status code, it is sent to the underlying ResponseWriter
+// on first Write, Flush or when handler returns. Delaying it until then allows
+// the compression decision to account for headers set by the handler after
+// calling WriteHeader, like Content-Encoding set by some nested middleware.
+// Informational 1xx status codes, like 103 Early Hints, are sent right away.
+func (g *gRW) WriteHeader(code int) {
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		g.w.WriteHeader(code)
+		return
+	}
+	if g.committed {
+		if g.out == nil {
+			g.w.WriteHeader(code)
+		}
+		return
+	}
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.code = code
+}
+
+// commit decides whether response should be compressed based on the headers
+// set so far and up to 512 first bytes of the body, and sends status code to
+// the underlying ResponseWriter.
+func (g *gRW) commit(head []byte) {
+	if g.committed {
+		return
+	}
+	g.committed = true
+	if !g.wroteHeader {
+		g.wroteHeader = true
+		g.code = http.StatusOK
+	}
+	if g.h.varyTypes != nil {
+		ct := g.w.Header().Get(hdrContentType)
+		if len(g.h.varyTypes) == 0 && g.h.compressible(ct) || matchTypes(g.h.varyTypes, ct) {
+			g.h.addVary(g.w.Header())
+		}
+	}
+	if !g.h.compressibleStatus(g.code) {
+		g.skipFor("status code")
+	}
+	g.init(head)
+	if g.h.commentHeader != "" {
+		g.setComment()
+	}
+	if g.h.hintHeader != "" {
+		g.w.Header().Del(g.h.hintHeader)
+	}
+	if g.out != nil {
+		return // headers are sent once the whole body is compressed
+	}
+	g.writeHeader()
+	if g.h.initialFlush && g.z != nil {
+		g.z.Flush()
+		if f, ok := g.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// setComment removes header configured with WithGzipCommentHeader, using its
+// value as gzip comment if response is compressed.
+func (g *gRW) setComment() {
+	v := g.w.Header().Get(g.h.commentHeader)
+	g.w.Header().Del(g.h.commentHeader)
+	z, ok := g.z.(*gzip.Writer)
+	if !ok || v == "" {
+		return
+	}
+	for _, r := range v {
+		if r == 0 || r > 0xff {
+			return
+		}
+	}
+	z.Comment = v
+}
 
-// WithLevel configures handler to use specified compression level. It will
-// panic if level is not one of the values accepted by gzip.NewWriterLevel.
-func WithLevel(level int) Option {
-	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
-		panic(err)
+// writeHeader sends headers and status code to the underlying ResponseWriter.
+func (g *gRW) writeHeader() {
+	if g.h.headerHook != nil {
+		g.h.headerHook(g.w.Header(), g.z != nil)
+	}
+	if g.h.strict && g.z != nil {
+		g.checkHeaders()
 	}
-	return func(g *gzipHandler) { g.writerPool = newWriterPool(level) }
+	g.w.WriteHeader(g.code)
 }
 
-// New returns a http.Handler that optionally compresses response using
-// 'Content-Enconding: gzip' scheme.
-func New(h http.Handler, options ...Option) http.Handler {
-	g := &gzipHandler{
-		h:          h,
-		writerPool: newWriterPool(gzip.BestSpeed),
+// checkHeaders panics if headers of compressed response are inconsistent.
+func (g *gRW) checkHeaders() {
+	hdr := g.w.Header()
+	if ce := hdr.Get(hdrContentEncoding); ce != g.enc.token {
+		panic(fmt.Sprintf("httpgzip: %s compressed response has Content-Encoding %q", g.enc.name, ce))
 	}
-	for _, fn := range options {
-		fn(g)
+	if v := hdr.Get(hdrContentRange); v != "" {
+		panic(fmt.Sprintf("httpgzip: compressed response has %s: %s", hdrContentRange, v))
+	}
+	if v := hdr.Get(hdrContentLength); v != "" && (g.out == nil || v != strconv.FormatInt(g.outLen(), 10)) {
+		panic(fmt.Sprintf("httpgzip: compressed response has %s: %s", hdrContentLength, v))
 	}
-	return g
 }
 
-type gzipHandler struct {
-	h          http.Handler
-	writerPool *pool
+func (g *gRW) Write(b []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if g.ctx != nil {
+		if err := g.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if len(b) != 0 {
+		g.markIn()
+	}
+	if !g.committed {
+		if len(b) == 0 {
+			// there is nothing to base decision on yet, but status code is
+			// fixed the same way http.ResponseWriter does it
+			g.WriteHeader(http.StatusOK)
+			return 0, nil
+		}
+		if g.http10 {
+			if len(g.buf)+len(b) <= g.h.http10Max {
+				g.buf = append(g.buf, b...)
+				return len(b), nil
+			}
+			g.skipFor("body too large to buffer")
+		} else if !g.skip && g.measuring() && len(g.buf)+len(b) < g.h.highWater {
+			g.buf = append(g.buf, b...)
+			return len(b), nil
+		}
+		head := g.head(b)
+		g.sniff(head)
+		g.commit(head)
+		if err := g.writeBuffered(); err != nil {
+			return 0, err
+		}
+	}
+	return g.write(b)
 }
 
-func (h *gzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Vary", hdrAcceptEncoding)
-	if !acceptsGzip(r) {
-		h.h.ServeHTTP(w, r)
-		return
+// threshold returns compression threshold for the response.
+func (g *gRW) threshold() int {
+	ct := g.w.Header().Get(hdrContentType)
+	if g.h.alwaysTypes != nil && matchTypes(g.h.alwaysTypes, ct) {
+		return 0
 	}
-	z := &gRW{w: w, pool: h.writerPool}
-	defer z.close()
-	h.h.ServeHTTP(z, r)
+	n := g.h.thresholdFor(ct)
+	if g.h.cdnThreshold > n && sharedCacheable(g.w.Header().Values("Cache-Control")) {
+		n = g.h.cdnThreshold
+	}
+	return n
 }
 
-type gRW struct {
-	w           http.ResponseWriter
-	z           *gzip.Writer
-	pool        *pool
-	skip        bool
-	wroteHeader bool // whether WriteHeader was called
+// sharedCacheable reports whether Cache-Control header values allow caching
+// response by shared caches.
+func sharedCacheable(values []string) bool {
+	var ok bool
+	for _, line := range values {
+		for _, d := range strings.Split(line, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "private" || strings.HasPrefix(d, "private="), d == "no-store":
+				return false
+			case d == "public", strings.HasPrefix(d, "max-age="), strings.HasPrefix(d, "s-maxage="):
+				ok = true
+			}
+		}
+	}
+	return ok
 }
 
-func (g *gRW) init() {
-	if g.skip || g.z != nil {
-		return
+// measuring reports whether body should be buffered until its size reaches
+// threshold before deciding whether to compress it. Besides measured mode,
+// this is done for error responses, which usually have short bodies without
+// Content-Length, like the ones written by http.Error.
+func (g *gRW) measuring() bool {
+	return g.h.measured || g.wroteHeader && g.code >= 400
+}
+
+func (g *gRW) write(b []byte) (int, error) {
+	if g.skip || g.z == nil {
+		g.markOut()
+		n, err := g.w.Write(b)
+		g.size += int64(n)
+		g.written += int64(n)
+		return n, err
 	}
-	if g.w.Header().Get(hdrContentRange) != "" {
-		g.skip = true
-		return
+	if g.h.strict {
+		g.checkHeaders()
+	}
+	var n int
+	var err error
+	if g.bw != nil {
+		n, err = g.bw.Write(b)
+	} else {
+		n, err = g.z.Write(b)
+	}
+	g.size += int64(n)
+	g.unflushed += int64(n)
+	return n, err
+}
+
+// head returns up to 512 first bytes of response body, which consists of the
+// buffered body followed by b.
+func (g *gRW) head(b []byte) []byte {
+	const sniffLen = 512 // see http.DetectContentType
+	data := g.buf
+	if len(data) == 0 {
+		data = b
+	} else if len(data) < sniffLen && len(b) != 0 {
+		if len(b) > sniffLen-len(data) {
+			b = b[:sniffLen-len(data)]
+		}
+		data = append(data[:len(data):len(data)], b...)
 	}
-	if g.w.Header().Get(hdrContentEncoding) != "" {
-		g.skip = true
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	return data
+}
+
+// sniff sets Content-Type header if handler did not set it, detecting it from
+// the extension of request path or the head of the body.
+func (g *gRW) sniff(head []byte) {
+	if g.w.Header().Get(hdrContentType) != "" {
 		return
 	}
-	if cl := g.w.Header().Get(hdrContentLength); cl != "" {
-		if n, err := strconv.Atoi(cl); err == nil && n < compressThreshold {
-			g.skip = true
+	if g.h.extDetection && g.r != nil {
+		if ct := mime.TypeByExtension(path.Ext(g.r.URL.Path)); ct != "" {
+			g.w.Header().Set(hdrContentType, ct)
+			g.sniffed = true
 			return
 		}
 	}
-	if ct := g.w.Header().Get(hdrContentType); ct != "" && !supportedContentType(ct) {
-		g.skip = true
+	if g.h.noDetection {
 		return
 	}
-	g.z = g.pool.Get()
-	g.z.Reset(g.w)
-	g.w.Header().Set(hdrContentEncoding, "gzip")
-	g.w.Header().Del(hdrContentLength)
+	detect := http.DetectContentType
+	if g.h.detector != nil {
+		detect = g.h.detector
+	}
+	g.w.Header().Set(hdrContentType, detect(head))
+	g.sniffed = true
 }
 
-func (g *gRW) Header() http.Header { return g.w.Header() }
-func (g *gRW) WriteHeader(code int) {
-	g.wroteHeader = true
-	if g.z == nil && code != http.StatusNoContent && code != http.StatusNotModified &&
-		code != http.StatusPartialContent {
-		g.init()
+// flushBuffered commits response if there is buffered body or status code,
+// and writes out the buffered body.
+func (g *gRW) flushBuffered() error {
+	if g.committed || !g.wroteHeader && len(g.buf) == 0 {
+		return nil
+	}
+	head := g.head(nil)
+	if len(head) != 0 {
+		g.sniff(head)
 	}
-	g.w.WriteHeader(code)
+	g.commit(head)
+	return g.writeBuffered()
 }
 
-func (g *gRW) Write(b []byte) (int, error) {
-	if !g.wroteHeader {
-		if g.w.Header().Get(hdrContentType) == "" {
-			g.w.Header().Set(hdrContentType, http.DetectContentType(b))
-		}
-		g.WriteHeader(http.StatusOK)
+func (g *gRW) writeBuffered() error {
+	if len(g.buf) == 0 {
+		return nil
 	}
-	if g.skip || g.z == nil {
-		return g.w.Write(b)
-	}
-	return g.z.Write(b)
+	b := g.buf
+	g.buf = nil
+	_, err := g.write(b)
+	return err
 }
 
+// Flush commits response if it is not yet committed, and flushes it. If no
+// body was written yet, compression decision is made from headers alone, and
+// if Content-Type is not set, response is sent uncompressed, as its content
+// type cannot be detected.
 func (g *gRW) Flush() {
-	if g.z != nil {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	if g.http10 && !g.committed {
+		g.skipFor("flushed before commit") // body size cannot be known before handler returns
+	}
+	if !g.committed && len(g.buf) == 0 {
+		if g.w.Header().Get(hdrContentType) == "" {
+			g.skipFor("content type")
+		}
+		g.commit(nil)
+	}
+	g.flushBuffered()
+	if g.out != nil {
+		return
+	}
+	if g.z != nil && g.shouldFlush() {
+		if g.bw != nil {
+			g.bw.Flush()
+		}
 		g.z.Flush()
+		g.unflushed = 0
 	}
 	if f, ok := g.w.(http.Flusher); ok {
 		f.Flush()
 	}
 }
 
+func (g *gRW) shouldFlush() bool {
+	switch p := g.h.flushPolicy; p {
+	case FlushAlways:
+		return true
+	case FlushNever:
+		return false
+	default:
+		return g.unflushed >= int64(p)
+	}
+}
+
 func (g *gRW) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.closed = true
+	if (g.measuring() || g.http10) && !g.committed {
+		// detect type before threshold check, as threshold may depend on it
+		if head := g.head(nil); len(head) != 0 {
+			g.sniff(head)
+		}
+		n := len(g.buf)
+		if g.headOnly && n == 0 {
+			// handlers usually write no body for HEAD requests, so rely
+			// on the declared length to match headers of GET response
+			if cl, err := strconv.Atoi(g.w.Header().Get(hdrContentLength)); err == nil {
+				n = cl
+			}
+		}
+		if n < g.threshold() {
+			g.skipFor("below threshold")
+		}
+	}
+	g.flushBuffered()
 	if g.z == nil {
+		if g.enc != nil { // observer and logger only see requests accepting encoding
+			g.observe("")
+			g.log("", nil)
+		}
 		return
 	}
-	g.z.Close()
+	var err error
+	if g.bw != nil {
+		err = g.bw.Flush()
+	}
+	if cerr := g.z.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && g.state != nil {
+		g.state.err = err
+	}
+	if g.out != nil {
+		g.writeOut()
+	}
 	if f, ok := g.w.(http.Flusher); ok {
 		f.Flush()
 	}
+	g.release()
+	if g.h.slowFn != nil {
+		if d := time.Since(g.started); d > g.h.slowThreshold {
+			g.h.slowFn(d, g.size, g.w.Header().Get(hdrContentType))
+		}
+	}
+	g.observe(g.enc.name)
+	g.log(g.enc.name, err)
+}
+
+// log logs compression decision and error finalizing compressed response, if
+// any, with the logger configured by WithLogger.
+func (g *gRW) log(encoding string, err error) {
+	l := g.h.logger
+	if l == nil {
+		return
+	}
+	ctx := context.Background()
+	if g.r != nil {
+		ctx = g.r.Context()
+	}
+	ct := g.w.Header().Get(hdrContentType)
+	if err != nil {
+		l.LogAttrs(ctx, slog.LevelWarn, "httpgzip: finalizing compressed response",
+			slog.String("encoding", encoding),
+			slog.String("content_type", ct),
+			slog.Any("error", err))
+	}
+	reason := g.reason
+	if encoding == "" && reason == "" {
+		reason = "no body"
+	}
+	l.LogAttrs(ctx, slog.LevelDebug, "httpgzip: compression decision",
+		slog.String("encoding", encoding),
+		slog.String("content_type", ct),
+		slog.Bool("skipped", encoding == ""),
+		slog.String("reason", reason),
+		slog.Int64("bytes_in", g.size),
+		slog.Int64("bytes_out", g.written))
+}
+
+// observe reports response statistics to the observer, if any.
+func (g *gRW) observe(encoding string) {
+	if g.h.observer == nil {
+		return
+	}
+	var ttfb time.Duration
+	if !g.firstIn.IsZero() && !g.firstOut.IsZero() {
+		ttfb = g.firstOut.Sub(g.firstIn)
+	}
+	g.h.observer(CompressionStats{
+		BytesIn:     g.size,
+		BytesOut:    g.written,
+		Encoding:    encoding,
+		ContentType: g.w.Header().Get(hdrContentType),
+		Sniffed:     g.sniffed,
+		TTFBDelay:   ttfb,
+	})
+}
+
+// markIn records time of the first write of the body by the wrapped handler,
+// if it is needed for observer.
+func (g *gRW) markIn() {
+	if g.h.observer != nil && g.firstIn.IsZero() {
+		g.firstIn = time.Now()
+	}
+}
+
+// markOut records time of the first write to the underlying ResponseWriter,
+// if it is needed for observer.
+func (g *gRW) markOut() {
+	if g.h.observer != nil && g.firstOut.IsZero() {
+		g.firstOut = time.Now()
+	}
+}
+
+// countingWriter writes to the underlying ResponseWriter of gRW, counting
+// bytes written.
+type countingWriter struct{ g *gRW }
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	c.g.markOut()
+	n, err := c.g.w.Write(b)
+	c.g.written += int64(n)
+	return n, err
+}
+
+// writeOut sends headers with Content-Length and optional Repr-Digest,
+// followed by the buffered compressed body.
+func (g *gRW) writeOut() {
+	if g.h.reprDigest {
+		sum := sha256.Sum256(g.out.Bytes())
+		g.w.Header().Set(hdrReprDigest, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}
+	if !g.headOnly || g.size != 0 {
+		g.w.Header().Set(hdrContentLength, strconv.FormatInt(g.outLen(), 10))
+	}
+	g.writeHeader()
+	if g.out.Len() != 0 {
+		g.markOut()
+	}
+	n, err := g.w.Write(g.out.Bytes())
+	g.written += int64(n)
+	if err != nil && g.state != nil && g.state.err == nil {
+		g.state.err = err
+	}
+	g.out = nil
+}
+
+// outLen returns size of compressed body.
+func (g *gRW) outLen() int64 { return int64(g.out.Len()) + g.discarded }
+
+// discardCounter is an io.Writer that discards data, adding its size to n.
+type discardCounter struct{ n *int64 }
+
+func (d discardCounter) Write(b []byte) (int, error) {
+	*d.n += int64(len(b))
+	return len(b), nil
+}
+
+// release returns compressing writer to the pool.
+func (g *gRW) release() {
+	if _, ok := g.z.(discardEncoder); ok {
+		g.z = nil
+		return
+	}
 	g.pool.Put(g.z)
 	g.z = nil
+	if g.bw != nil {
+		g.bw.Reset(nil)
+		g.h.bufPool.Put(g.bw)
+		g.bw = nil
+	}
+	if g.h.sem != nil {
+		<-g.h.sem
+	}
+}
+
+// detach stops handling response once the connection was taken over.
+func (g *gRW) detach() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	if g.z != nil {
+		g.release()
+	}
 }
 
 func (g *gRW) Unwrap() http.ResponseWriter { return g.w }
 
-// acceptsGzip returns true if the given HTTP request indicates that it will
-// accept a gzipped response.
-func acceptsGzip(r *http.Request) bool {
-	return allowsGzip(r.Header.Get(hdrAcceptEncoding))
+// Hijack implements http.Hijacker if any of the wrapped ResponseWriters does,
+// otherwise it returns an error wrapping http.ErrNotSupported.
+func (g *gRW) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	for w := g.w; w != nil; w = unwrap(w) {
+		if hj, ok := w.(http.Hijacker); ok {
+			conn, rw, err := hj.Hijack()
+			if err == nil {
+				g.detach()
+			}
+			return conn, rw, err
+		}
+	}
+	return nil, nil, fmt.Errorf("httpgzip: hijack: %w", http.ErrNotSupported)
 }
 
-func allowsGzip(hdr string) bool {
-	if !strings.Contains(hdr, "gzip") {
-		return false
+// Push implements http.Pusher if the underlying ResponseWriter does,
+// otherwise it returns http.ErrNotSupported.
+func (g *gRW) Push(target string, opts *http.PushOptions) error {
+	if p, ok := g.w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// ReadFrom implements io.ReaderFrom. Once response is known to be sent
+// uncompressed, it uses ReadFrom method of the underlying ResponseWriter, if
+// any, so that io.Copy from a file can use sendfile(2). If nothing was written
+// yet, and Content-Type set by handler is not compressible, response is
+// committed right away. Otherwise Content-Type is detected from the first
+// bytes read from r, if needed, and compression decision is made as on Write.
+func (g *gRW) ReadFrom(r io.Reader) (int64, error) {
+	if n, err, ok := g.readFromDirect(r); ok {
+		return n, err
+	}
+	return io.Copy(writerOnly{g}, r)
+}
+
+// readFromDirect copies r using ReadFrom method of the underlying
+// ResponseWriter if response is sent uncompressed, it reports false if it
+// cannot be used.
+func (g *gRW) readFromDirect(r io.Reader) (int64, error, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.committed && !g.closed && len(g.buf) == 0 {
+		if ct := g.w.Header().Get(hdrContentType); ct != "" && !g.h.compressible(ct) {
+			g.commit(nil)
+		}
+	}
+	if g.committed && !g.closed && (g.skip || g.z == nil) {
+		if rf, ok := g.w.(io.ReaderFrom); ok {
+			g.markIn()
+			g.markOut()
+			n, err := rf.ReadFrom(r)
+			g.size += n
+			g.written += n
+			return n, err, true
+		}
+	}
+	return 0, nil, false
+}
+
+// writerOnly hides all methods of io.Writer except Write, so that io.Copy
+// does not call ReadFrom recursively.
+type writerOnly struct{ io.Writer }
+
+// WriteString implements io.StringWriter.
+func (g *gRW) WriteString(s string) (int, error) { return g.Write([]byte(s)) }
+
+// SetReadDeadline sets read deadline on the underlying connection, see
+// http.ResponseController. It returns an error wrapping http.ErrNotSupported if
+// none of the wrapped ResponseWriters supports it.
+func (g *gRW) SetReadDeadline(t time.Time) error {
+	for w := g.w; w != nil; w = unwrap(w) {
+		if d, ok := w.(interface{ SetReadDeadline(time.Time) error }); ok {
+			return d.SetReadDeadline(t)
+		}
+	}
+	return fmt.Errorf("httpgzip: set read deadline: %w", http.ErrNotSupported)
+}
+
+// SetWriteDeadline sets write deadline on the underlying connection, see
+// http.ResponseController. It returns an error wrapping http.ErrNotSupported if
+// none of the wrapped ResponseWriters supports it.
+func (g *gRW) SetWriteDeadline(t time.Time) error {
+	for w := g.w; w != nil; w = unwrap(w) {
+		if d, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			return d.SetWriteDeadline(t)
+		}
+	}
+	return fmt.Errorf("httpgzip: set write deadline: %w", http.ErrNotSupported)
+}
+
+// unwrap returns ResponseWriter wrapped by w, or nil if w does not wrap any.
+func unwrap(w http.ResponseWriter) http.ResponseWriter {
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+// Conn returns the underlying network connection. It walks the chain of
+// wrapped ResponseWriters, looking for the one that either has a
+// "Conn() net.Conn" method, or implements http.Hijacker. In the latter case
+// the connection is hijacked, so the caller becomes responsible for closing
+// it, and must not use ResponseWriter afterwards. Conn reports false if the
+// connection is not available.
+func (g *gRW) Conn() (net.Conn, bool) {
+	w := g.w
+	for {
+		switch v := w.(type) {
+		case interface{ Conn() net.Conn }:
+			return v.Conn(), true
+		case http.Hijacker:
+			conn, _, err := v.Hijack()
+			if err != nil {
+				return nil, false
+			}
+			g.detach()
+			return conn, true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// WillCompress reports whether response written to w, which is either the
+// ResponseWriter passed by handler to the wrapped one, or a ResponseWriter
+// wrapping it, will be compressed, judging by the headers set so far and the
+// body buffered, if any. Calling it does not commit the response. If the
+// decision depends on the body not written yet, like when Content-Type is not
+// set, decided is false. Handlers that are able to produce compressed content
+// themselves can use it to avoid compressing it twice: if compress is false,
+// they may set Content-Encoding header and write compressed body, which is then
+// passed as is. Even if WillCompress reports true, response may still be sent
+// uncompressed if limit set with WithMaxConcurrency is reached.
+func WillCompress(w http.ResponseWriter) (compress, decided bool) {
+	for {
+		if g, ok := w.(*gRW); ok {
+			return g.willCompress()
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false, true
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (g *gRW) willCompress() (compress, decided bool) {
+	if g.committed || g.closed {
+		return !g.skip && g.z != nil, true
+	}
+	code := g.code
+	if !g.wroteHeader {
+		code = http.StatusOK
+	}
+	head := g.head(nil)
+	if g.skip || g.w == nil || !g.h.compressibleStatus(code) || g.rejection(code, head) != "" {
+		return false, true
+	}
+	switch {
+	case g.w.Header().Get(hdrContentType) == "",
+		(g.measuring() || g.http10) && len(g.buf) < g.threshold(),
+		g.h.maxEntropy > 0 && len(head) == 0:
+		return false, false
+	}
+	return true, true
+}
+
+// negotiate returns the most preferred configured encoding that the given
+// HTTP request indicates it will accept, or nil if there's none.
+func (h *gzipHandler) negotiate(r *http.Request) *encoding {
+	if enc := h.selectEncoding(r.Header.Get(hdrAcceptEncoding)); enc != nil {
+		return enc
+	}
+	if h.aeHeader != "" {
+		return h.selectEncoding(r.Header.Get(h.aeHeader))
+	}
+	return nil
+}
+
+// selectEncoding returns configured encoding that Accept-Encoding header value
+// hdr gives the highest quality value, preferring encodings in the configured
+// order among the ones with equal quality. It returns nil if header does not
+// allow any of them.
+func (h *gzipHandler) selectEncoding(hdr string) *encoding {
+	if hdr == "" {
+		return nil
+	}
+	cacheable := h.aeCache != nil && len(hdr) <= aeCacheMaxLen
+	if cacheable {
+		if v, ok := h.aeCache.m.Load(hdr); ok {
+			if i := v.(int); i >= 0 {
+				return &h.encodings[i]
+			}
+			return nil
+		}
+	}
+	best := -1
+	var bestQ float64
+	if h.honorPreference {
+		bestQ, _ = codingQuality(hdr, identity)
+	}
+	for i := range h.encodings {
+		if q, _ := codingQuality(hdr, h.encodings[i].name); q > bestQ && q >= h.minQuality {
+			best, bestQ = i, q
+		}
+	}
+	if cacheable && atomic.LoadInt32(&h.aeCache.n) < aeCacheSize && atomic.AddInt32(&h.aeCache.n, 1) <= aeCacheSize {
+		h.aeCache.m.Store(hdr, best)
 	}
-	for _, ss := range strings.Split(hdr, ",") {
-		parts := strings.SplitN(ss, ";", 2)
-		if l := len(parts); l == 0 || strings.TrimSpace(parts[0]) != "gzip" {
+	if best < 0 {
+		return nil
+	}
+	return &h.encodings[best]
+}
+
+const (
+	aeCacheSize   = 1024 // max number of entries in aeCache
+	aeCacheMaxLen = 128  // max length of header value to cache
+)
+
+// aeCache caches results of selectEncoding for frequently seen
+// Accept-Encoding header values. It stops growing once it holds aeCacheSize
+// entries, so that it cannot be exhausted by clients sending unique values.
+type aeCache struct {
+	m sync.Map // header value to index in encodings, or -1
+	n int32    // number of attempts to add an entry, accessed atomically
+}
+
+// allowsGzip reports whether Accept-Encoding header value allows gzip coding.
+func allowsGzip(hdr string) bool { return allowsCoding(hdr, "gzip") }
+
+// allowsCoding reports whether Accept-Encoding header value allows given
+// lowercase content-coding.
+func allowsCoding(hdr, coding string) bool {
+	q, _ := codingQuality(hdr, coding)
+	return q > 0
+}
+
+// codingQuality returns quality value that Accept-Encoding header value gives
+// to the lowercase content-coding, and whether the coding is listed there.
+// Malformed quality values are treated as zero. Content-coding values are
+// case-insensitive, see RFC 9110, section 8.4.1.
+func codingQuality(hdr, coding string) (float64, bool) {
+	for hdr != "" {
+		entry := hdr
+		if i := strings.IndexByte(hdr, ','); i >= 0 {
+			entry, hdr = hdr[:i], hdr[i+1:]
+		} else {
+			hdr = ""
+		}
+		name, params, hasParams := entry, "", false
+		if i := strings.IndexByte(entry, ';'); i >= 0 {
+			name, params, hasParams = entry[:i], entry[i+1:], true
+		}
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
 			continue
-		} else if l == 1 {
-			return true
 		}
-		p := strings.TrimSpace(parts[1])
-		if qv := strings.TrimPrefix(p, "q="); qv != p {
-			if q, err := strconv.ParseFloat(qv, 64); err == nil {
-				return q > 0
+		if !hasParams {
+			return 1, true
+		}
+		p := strings.TrimSpace(params)
+		if len(p) >= 2 && (p[0] == 'q' || p[0] == 'Q') && p[1] == '=' {
+			if q, err := strconv.ParseFloat(p[2:], 64); err == nil {
+				return q, true
+			}
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// compressible reports whether content of the given type should be compressed.
+func (h *gzipHandler) compressible(ct string) bool {
+	if h.exactTypes != nil {
+		ct = mediaType(ct)
+		for _, s := range h.exactTypes {
+			if ct == s {
+				return true
 			}
-			return false
 		}
 		return false
 	}
+	if h.contentTypes == nil {
+		return supportedContentType(ct)
+	}
+	return matchTypes(h.contentTypes, ct)
+}
+
+// matchTypes reports whether media type of Content-Type header value ct
+// matches any of values in the format accepted by WithContentTypes.
+func matchTypes(list []string, ct string) bool {
+	ct = mediaType(ct)
+	for _, s := range list {
+		if strings.HasPrefix(ct, s) || s[0] == '+' && strings.HasSuffix(ct, s) {
+			return true
+		}
+	}
 	return false
 }
 
+// mediaType returns lowercase media type of Content-Type header value,
+// without parameters.
+func mediaType(s string) string {
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// supportedContentType reports whether content of the given media type is
+// worth compressing. These are text/* types, image/svg+xml, and application/*
+// types which subtype contains "json", "javascript", "ecmascript" or "xml" as
+// a substring, so that types like "application/ld+json" or
+// "application/x-javascript" match too. Media type parameters are ignored.
+// Multipart types are not compressed, as their parts may be binary, use
+// WithContentTypes to enable specific multipart subtypes.
 func supportedContentType(s string) bool {
-	switch s {
+	switch s = mediaType(s); s {
 	case "":
 		return false
 	case "image/svg+xml":
@@ -186,19 +2270,93 @@ func supportedContentType(s string) bool {
 	if strings.HasPrefix(s, "text/") {
 		return true
 	}
-	if strings.HasPrefix(s, "application/") && (strings.Contains(s, "json") ||
-		strings.Contains(s, "javascript") ||
-		strings.Contains(s, "xml")) {
-		return true
+	if sub := strings.TrimPrefix(s, "application/"); sub != s {
+		return strings.Contains(sub, "json") ||
+			strings.Contains(sub, "javascript") ||
+			strings.Contains(sub, "ecmascript") ||
+			strings.Contains(sub, "xml")
 	}
 	return false
 }
 
-func newWriterPool(level int) *pool {
+// discardEncoder is an encoder that discards all data, used for responses to
+// HEAD requests.
+type discardEncoder struct{}
+
+func (discardEncoder) Write(b []byte) (int, error) { return len(b), nil }
+func (discardEncoder) Close() error                { return nil }
+func (discardEncoder) Flush() error                { return nil }
+func (discardEncoder) Reset(io.Writer)             {}
+
+// encoder is a compressing writer, it is implemented by gzip.Writer and
+// zlib.Writer.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// coding describes supported content-coding.
+type coding struct {
+	name      string // content-coding token as used in HTTP headers
+	newWriter func(level int) (encoder, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codingGzip = &coding{
+		name: "gzip",
+		newWriter: func(level int) (encoder, error) {
+			w, err := gzip.NewWriterLevel(io.Discard, level)
+			if err != nil {
+				return nil, err
+			}
+			return w, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	}
+	// codingDeflate is "deflate" content-coding, which is zlib format, see
+	// RFC 9110, section 8.4.1.2.
+	codingDeflate = &coding{
+		name: "deflate",
+		newWriter: func(level int) (encoder, error) {
+			w, err := zlib.NewWriterLevel(io.Discard, level)
+			if err != nil {
+				return nil, err
+			}
+			return w, nil
+		},
+		newReader: zlib.NewReader,
+	}
+)
+
+var codings = map[string]*coding{
+	codingGzip.name:    codingGzip,
+	codingDeflate.name: codingDeflate,
+}
+
+// entropy returns Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	n := float64(len(b))
+	for _, c := range counts {
+		if c != 0 {
+			p := float64(c) / n
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+func newWriterPool(c *coding, level int) *pool {
 	return &pool{
-		sync.Pool{
+		Pool: sync.Pool{
 			New: func() interface{} {
-				w, err := gzip.NewWriterLevel(io.Discard, level)
+				w, err := c.newWriter(level)
 				if err != nil {
 					panic(err)
 				}
@@ -210,7 +2368,20 @@ func newWriterPool(level int) *pool {
 
 type pool struct {
 	sync.Pool
+	src WriterPool // if set, used instead of sync.Pool
+}
+
+func (p *pool) Get() encoder {
+	if p.src != nil {
+		return p.src.Get()
+	}
+	return p.Pool.Get().(encoder)
 }
 
-func (p *pool) Get() *gzip.Writer  { return p.Pool.Get().(*gzip.Writer) }
-func (p *pool) Put(w *gzip.Writer) { p.Pool.Put(w) }
+func (p *pool) Put(w encoder) {
+	if p.src != nil {
+		p.src.Put(w.(*gzip.Writer))
+		return
+	}
+	p.Pool.Put(w)
+}
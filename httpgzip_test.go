@@ -1,17 +1,45 @@
 package httpgzip
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 const hello = "Hello, world!\n"
 
+// raceEnabled is true if tests are built with race detector, which makes
+// sync.Pool drop items at random
+var raceEnabled bool
+
 func TestExplicitStatusCode(t *testing.T) {
 	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
 	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -75,6 +103,33 @@ func TestSkipOnHeader(t *testing.T) {
 	t.Run("non-gzipped", testFunc(handler, false, false, content))
 }
 
+func TestPreEncodedResponse(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", r.URL.Query().Get("ce"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content))
+	})
+	for _, h := range []http.Handler{New(inner), New(inner, WithMeasuredThreshold())} {
+		for _, ce := range []string{"br", "zstd", "gzip"} {
+			r := httptest.NewRequest(http.MethodGet, "/?ce="+ce, nil)
+			r.Header.Set(hdrAcceptEncoding, "gzip, br, zstd")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Header().Values("Content-Encoding"); len(got) != 1 || got[0] != ce {
+				t.Errorf("%s: got Content-Encoding %q, want %q", ce, got, ce)
+			}
+			if got, want := w.Header().Get("Content-Length"), strconv.Itoa(len(content)); got != want {
+				t.Errorf("%s: got Content-Length %q, want %q", ce, got, want)
+			}
+			if w.Body.String() != content {
+				t.Errorf("%s: body was modified", ce)
+			}
+		}
+	}
+}
+
 func TestSkipOnSizeThreshold(t *testing.T) {
 	content := strings.Repeat(hello, compressThreshold/len(hello)-1)
 	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -118,6 +173,18 @@ func testFunc(h http.Handler, acceptGzip, expectGzip bool, want string) func(*te
 	}
 }
 
+// serve makes GET request to h with given Accept-Encoding header value, and
+// returns recorded response.
+func serve(h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if acceptEncoding != "" {
+		r.Header.Set(hdrAcceptEncoding, acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
 func readAllGzipped(r io.Reader) ([]byte, error) {
 	rd, err := gzip.NewReader(r)
 	if err != nil {
@@ -127,27 +194,49 @@ func readAllGzipped(r io.Reader) ([]byte, error) {
 	return io.ReadAll(rd)
 }
 
+var allowsGzipExamples = []struct {
+	hdr  string
+	want bool
+}{
+	// Examples from RFC 2616
+	{"compress, gzip", true},
+	{"", false},
+	{"*", false},
+	{"compress;q=0.5, gzip;q=1.0", true},
+	{"gzip;q=1.0, identity; q=0.5, *;q=0", true},
+
+	// More random stuff
+	{"gzip;BAD, *q;q=0", false},
+	{"gzip; q=X, *q;q=0", false},
+	{"gzip;q=0.0, *;q=0", false},
+	{"fgzip", false},
+	{"AAA;q=1", false},
+	{"BBB ; q = 2", false},
+
+	// Case-insensitive coding names
+	{"GZIP", true},
+	{"Gzip", true},
+	{"gZip;q=0.5", true},
+	{"deflate, GZIP;Q=0", false},
+
+	// Explicit refusal, with optional whitespace around semicolon
+	{"gzip;q=0", false},
+	{"gzip; q=0", false},
+	{"gzip ;q=0", false},
+	{"gzip ; q=0", false},
+	{"gzip;\tq=0", false},
+	{"gzip; q=0.5", true},
+	{"gzip ; q=0.5 ", true},
+
+	// Malformed but non-empty values
+	{",", false},
+	{" , ,", false},
+	{";", false},
+	{";q=1", false},
+}
+
 func TestAllowsGzip(t *testing.T) {
-	examples := []struct {
-		hdr  string
-		want bool
-	}{
-		// Examples from RFC 2616
-		{"compress, gzip", true},
-		{"", false},
-		{"*", false},
-		{"compress;q=0.5, gzip;q=1.0", true},
-		{"gzip;q=1.0, identity; q=0.5, *;q=0", true},
-
-		// More random stuff
-		{"gzip;BAD, *q;q=0", false},
-		{"gzip; q=X, *q;q=0", false},
-		{"gzip;q=0.0, *;q=0", false},
-		{"fgzip", false},
-		{"AAA;q=1", false},
-		{"BBB ; q = 2", false},
-	}
-	for n, ex := range examples {
+	for n, ex := range allowsGzipExamples {
 		if got := allowsGzip(ex.hdr); got != ex.want {
 			t.Fatalf("[%d] %q: got %v, want %v", n, ex.hdr, got, ex.want)
 		}
@@ -198,3 +287,3130 @@ func TestWithLevel(t *testing.T) {
 	t.Run("good#1", func(t *testing.T) { fn(t, gzip.HuffmanOnly, false) })
 	t.Run("good#2", func(t *testing.T) { fn(t, gzip.BestCompression, false) })
 }
+
+func TestHuffmanOnly(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)*4)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, content)
+	}), WithLevel(gzip.HuffmanOnly), WithEncodings("gzip", "deflate"))
+	// repeat requests so that writers are reused from the pool
+	for i := 0; i < 3; i++ {
+		for _, coding := range []string{"gzip", "deflate"} {
+			w := serve(handler, coding)
+			if ce := w.Header().Get("Content-Encoding"); ce != coding {
+				t.Fatalf("got Content-Encoding %q, want %q", ce, coding)
+			}
+			if w.Body.Len() >= len(content) {
+				t.Errorf("%s: got %d bytes of %d, content is not compressed", coding, w.Body.Len(), len(content))
+			}
+			var rd io.ReadCloser
+			var err error
+			if coding == "gzip" {
+				rd, err = gzip.NewReader(w.Body)
+			} else {
+				rd, err = zlib.NewReader(w.Body)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", coding, err)
+			}
+			if data, err := io.ReadAll(rd); err != nil || string(data) != content {
+				t.Fatalf("%s: read content differs from served, error: %v", coding, err)
+			}
+		}
+	}
+}
+
+func TestWithAcceptEncodingHeader(t *testing.T) {
+	t.Parallel()
+	const hdr = "X-Forwarded-Accept-Encoding"
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}), WithAcceptEncodingHeader(hdr))
+	for _, tc := range []struct {
+		name       string
+		hdr, value string
+		wantGzip   bool
+	}{
+		{"standard", hdrAcceptEncoding, "gzip", true},
+		{"alternate", hdr, "gzip", true},
+		{"alternate refused", hdr, "gzip;q=0", false},
+		{"none", "", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.hdr != "" {
+			r.Header.Set(tc.hdr, tc.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		result := w.Result()
+		if got := result.Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+		}
+		if vary := result.Header.Values("Vary"); len(vary) != 2 || vary[1] != hdr {
+			t.Errorf("%s: unexpected Vary: %q", tc.name, vary)
+		}
+	}
+}
+
+func TestLateContentEncoding(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Encoding", "identity")
+		w.Write([]byte(content))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if ce := w.Result().Header.Get("Content-Encoding"); ce != "identity" {
+		t.Fatalf("want Content-Encoding: identity, got %q", ce)
+	}
+	if w.Body.String() != content {
+		t.Fatal("read content differs from served")
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	cfg := NewConfig(WithLevel(gzip.BestCompression))
+	h1 := NewWithConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}), cfg)
+	h2 := NewWithConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.ToUpper(content)))
+	}), cfg)
+	if h1.(*gzipHandler).encodings[0].pool != h2.(*gzipHandler).encodings[0].pool {
+		t.Fatal("handlers created from the same config do not share writers pool")
+	}
+	t.Run("first", testFunc(h1, true, true, content))
+	t.Run("second", testFunc(h2, true, true, strings.ToUpper(content)))
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	done := make(chan error, 1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+		// goroutine outliving handler keeps writing until it gets an error
+		go func() {
+			for {
+				if _, err := w.Write([]byte(hello)); err != nil {
+					w.(http.Flusher).Flush()
+					done <- err
+					return
+				}
+			}
+		}()
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	size := w.Body.Len()
+	if err := <-done; err != ErrWriteAfterClose {
+		t.Fatalf("got error %v, want %v", err, ErrWriteAfterClose)
+	}
+	if w.Body.Len() != size {
+		t.Fatal("late write reached underlying ResponseWriter")
+	}
+	data, err := readAllGzipped(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest := strings.TrimPrefix(string(data), content); rest == string(data) || strings.ReplaceAll(rest, hello, "") != "" {
+		t.Fatal("read content differs from served")
+	}
+}
+
+func TestWithPredicate(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}), WithPredicate(func(r *http.Request) bool { return r.URL.Path != "/raw" }))
+	t.Run("gzipped", testFunc(handler, true, true, content))
+	r := httptest.NewRequest(http.MethodGet, "/raw", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if ce := w.Result().Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("want empty Content-Encoding, got %q", ce)
+	}
+	if vary := w.Result().Header.Get("Vary"); vary != "" {
+		t.Fatalf("want empty Vary, got %q", vary)
+	}
+	if w.Body.String() != content {
+		t.Fatal("read content differs from served")
+	}
+}
+
+func BenchmarkSkip(b *testing.B) {
+	content := []byte(strings.Repeat(hello, compressThreshold/len(hello)+1))
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(content)
+	})
+	bench := func(h http.Handler) func(b *testing.B) {
+		return func(b *testing.B) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(hdrAcceptEncoding, "gzip")
+			w := &discardWriter{header: make(http.Header)}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for k := range w.header {
+					delete(w.header, k)
+				}
+				h.ServeHTTP(w, r)
+			}
+		}
+	}
+	b.Run("content-type", bench(New(inner)))
+	b.Run("predicate", bench(New(inner, WithPredicate(func(*http.Request) bool { return false }))))
+}
+
+// discardWriter is a http.ResponseWriter that discards all writes
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func TestHTTP2(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	srv := httptest.NewUnstartedServer(New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(2*len(content)))
+		w.Write([]byte(content))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(content))
+	})))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(hdrAcceptEncoding, "gzip")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("response protocol is %s, want HTTP/2", resp.Proto)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("want Content-Encoding: gzip, got %q", ce)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" || resp.ContentLength != -1 {
+		t.Fatalf("compressed response has Content-Length: %q", cl)
+	}
+	data, err := readAllGzipped(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content+content {
+		t.Fatal("read content differs from served")
+	}
+}
+
+func TestWithMeasuredThreshold(t *testing.T) {
+	small := strings.Repeat("x", compressThreshold-1)
+	large := strings.Repeat("x", compressThreshold)
+	write := func(chunks ...string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, s := range chunks {
+				if s == "" {
+					w.(http.Flusher).Flush()
+					continue
+				}
+				w.Write([]byte(s))
+			}
+		}), WithMeasuredThreshold())
+	}
+	t.Run("below", testFunc(write(small[:10], small[10:]), true, false, small))
+	t.Run("above", testFunc(write(large[:10], large[10:]), true, true, large))
+	t.Run("above-single", testFunc(write(large), true, true, large))
+	t.Run("flush", testFunc(write(small[:10], "", small[10:]), true, true, small))
+	t.Run("non-gzipped", testFunc(write(large), false, false, large))
+}
+
+func TestWithEncodings(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	})
+	gzipFirst := New(inner, WithEncodings("gzip", "deflate"))
+	deflateFirst := New(inner, WithEncodings("deflate", "gzip"))
+	for _, tc := range []struct {
+		h      http.Handler
+		accept string
+		want   string
+	}{
+		{gzipFirst, "gzip", "gzip"},
+		{gzipFirst, "deflate", "deflate"},
+		{gzipFirst, "deflate, gzip", "gzip"},
+		{gzipFirst, "br", ""},
+		{deflateFirst, "gzip, deflate", "deflate"},
+		{deflateFirst, "gzip, deflate;q=0", "gzip"},
+		{New(inner), "deflate", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, tc.accept)
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		result := w.Result()
+		if ce := result.Header.Values("Content-Encoding"); len(ce) > 1 ||
+			result.Header.Get("Content-Encoding") != tc.want {
+			t.Fatalf("%q: got Content-Encoding %q, want %q", tc.accept, ce, tc.want)
+		}
+		var data []byte
+		var err error
+		switch tc.want {
+		case "gzip":
+			data, err = readAllGzipped(w.Body)
+		case "deflate":
+			var rd io.ReadCloser
+			if rd, err = zlib.NewReader(w.Body); err == nil {
+				data, err = io.ReadAll(rd)
+			}
+		default:
+			data, err = io.ReadAll(w.Body)
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tc.accept, err)
+		}
+		if string(data) != content {
+			t.Fatalf("%q: read content differs from served", tc.accept)
+		}
+	}
+}
+
+func TestWithEncodingsPanics(t *testing.T) {
+	for _, names := range [][]string{nil, {"gzip", "br"}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("WithEncodings(%q) does not panic", names)
+				}
+			}()
+			WithEncodings(names...)
+		}()
+	}
+}
+
+func TestWithSlowCompressionThreshold(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	})
+	var calls int
+	var gotSize int64
+	var gotType string
+	fn := func(d time.Duration, size int64, contentType string) {
+		calls++
+		gotSize, gotType = size, contentType
+	}
+	serve(New(inner, WithSlowCompressionThreshold(time.Hour, fn)), "gzip")
+	if calls != 0 {
+		t.Fatalf("callback called %d times for fast compression", calls)
+	}
+	serve(New(inner, WithSlowCompressionThreshold(time.Nanosecond, fn)), "gzip")
+	if calls != 1 {
+		t.Fatalf("callback called %d times, want 1", calls)
+	}
+	if gotSize != int64(len(content)) || gotType != "text/plain" {
+		t.Fatalf("callback got size %d, content type %q", gotSize, gotType)
+	}
+}
+
+func TestSupportedContentType(t *testing.T) {
+	examples := []struct {
+		ct   string
+		want bool
+	}{
+		{"", false},
+		{"text/plain", true},
+		{"text/html; charset=utf-8", true},
+		{"Text/CSS", true},
+		{" text/plain", true},
+		{"text/plain ", true},
+		{"\ttext/html", true},
+		{" application/json ; charset=utf-8", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"application/json", true},
+		{"application/ld+json", true},
+		{"application/manifest+json", true},
+		{"application/manifest+json; charset=utf-8", true},
+		{"application/javascript", true},
+		{"application/x-javascript", true},
+		{"application/ecmascript", true},
+		{"application/ecmascript-nonsense", true}, // substring match
+		{"application/xml", true},
+		{"application/octet-stream", false},
+		{"application/octet-stream; format=json", false},
+		{"text/csv", true},
+		{"text/csv; charset=utf-8; header=present", true},
+		{"text/tab-separated-values", true},
+		{"application/csv", false},
+		{"multipart/mixed; boundary=xyz", false},
+		{"multipart/byteranges; boundary=xyz", false},
+	}
+	for _, ex := range examples {
+		if got := supportedContentType(ex.ct); got != ex.want {
+			t.Errorf("%q: got %v, want %v", ex.ct, got, ex.want)
+		}
+	}
+}
+
+func TestWebAppManifest(t *testing.T) {
+	content := `{"name":"test","icons":[` + strings.Repeat(`{"src":"icon.png","sizes":"192x192"},`, 30) + `{}]}`
+	handler := func(ct string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte(content))
+		}), options...)
+	}
+	suffix := WithContentTypes(DefaultContentTypes()...)
+	for _, ct := range []string{"application/manifest+json", "application/manifest+json; charset=utf-8"} {
+		t.Run(ct, testFunc(handler(ct), true, true, content))
+		t.Run(ct+" suffix", testFunc(handler(ct, suffix), true, true, content))
+	}
+}
+
+func TestServeContentJavaScript(t *testing.T) {
+	content := strings.Repeat("console.log('Hello, world!');\n", compressThreshold/10)
+	for _, ct := range []string{"", "text/javascript; charset=utf-8", "application/javascript"} {
+		ct := ct
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			http.ServeContent(w, r, "app.js", time.Time{}, strings.NewReader(content))
+		}))
+		name := ct
+		if name == "" {
+			name = "by-extension"
+		}
+		t.Run(name, testFunc(handler, true, true, content))
+	}
+}
+
+func TestWithMaxConcurrency(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var handler http.Handler
+	var nested *httptest.ResponseRecorder
+	handler = New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+		if r.URL.Path == "/" {
+			nested = httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/nested", nil)
+			r.Header.Set(hdrAcceptEncoding, "gzip")
+			handler.ServeHTTP(nested, r)
+		}
+	}), WithMaxConcurrency(1))
+	if ce := serve(handler, "gzip").Result().Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("want Content-Encoding: gzip, got %q", ce)
+	}
+	if ce := nested.Result().Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("request over concurrency limit has Content-Encoding %q", ce)
+	}
+	if nested.Body.String() != content {
+		t.Fatal("read content differs from served")
+	}
+	if ce := serve(handler, "gzip").Result().Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("concurrency slot was not released, got Content-Encoding %q", ce)
+	}
+}
+
+func TestWithPrewarm(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under race detector")
+	}
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	const n = 3
+	for _, enc := range New(nil, WithPrewarm(n), WithEncodings("gzip", "deflate")).(*gzipHandler).encodings {
+		var allocs int
+		newFn := enc.pool.New
+		enc.pool.New = func() interface{} { allocs++; return newFn() }
+		for i := 0; i < n; i++ {
+			if enc.pool.Get() == nil {
+				t.Fatal("pool returned nil writer")
+			}
+		}
+		if allocs != 0 {
+			t.Fatalf("%s: prewarmed pool allocated %d writers out of %d", enc.name, allocs, n)
+		}
+		enc.pool.Get()
+		if allocs != 1 {
+			t.Fatalf("%s: pool allocated %d writers after prewarmed ones were used, want 1", enc.name, allocs)
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithPrewarm(-1) does not panic")
+			}
+		}()
+		WithPrewarm(-1)
+	}()
+}
+
+func TestWithVary(t *testing.T) {
+	t.Parallel()
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	outer := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin, accept-encoding")
+			h.ServeHTTP(w, r)
+		})
+	}
+	for _, tc := range []struct {
+		h    http.Handler
+		want string
+	}{
+		{New(inner, WithVary("Accept-Language")), "Accept-Language, Accept-Encoding"},
+		{New(inner, WithVary("Accept-Language", "Cookie", "accept-language")), "Accept-Language, Cookie, Accept-Encoding"},
+		{outer(New(inner, WithVary("Accept-Language"))), "Origin, accept-encoding, Accept-Language"},
+		{New(inner, WithAcceptEncodingHeader("X-AE"), WithVary("Accept-Encoding")), "Accept-Encoding, X-Ae"},
+	} {
+		for _, ae := range []string{"gzip", ""} {
+			vary := serve(tc.h, ae).Result().Header.Values("Vary")
+			if len(vary) != 1 || vary[0] != tc.want {
+				t.Errorf("got Vary %q, want %q", vary, tc.want)
+			}
+		}
+	}
+}
+
+func TestWithVaryOnlyForTypes(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.URL.Query().Get("ct"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Write([]byte(content))
+	})
+	for _, tc := range []struct {
+		h          http.Handler
+		ct, accept string
+		wantVary   string
+	}{
+		{New(inner, WithVaryOnlyForTypes("text/")), "text/html", "gzip", "Accept-Encoding"},
+		{New(inner, WithVaryOnlyForTypes("text/")), "text/html", "", "Accept-Encoding"},
+		{New(inner, WithVaryOnlyForTypes("text/")), "", "", "Accept-Encoding"},
+		{New(inner, WithVaryOnlyForTypes("text/")), "image/png", "gzip", ""},
+		{New(inner, WithVaryOnlyForTypes("text/")), "image/png", "", ""},
+		{New(inner, WithVaryOnlyForTypes()), "application/json", "", "Accept-Encoding"},
+		{New(inner, WithVaryOnlyForTypes()), "image/png", "gzip", ""},
+		{New(inner), "image/png", "gzip", "Accept-Encoding"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?ct="+url.QueryEscape(tc.ct), nil)
+		if tc.accept != "" {
+			r.Header.Set(hdrAcceptEncoding, tc.accept)
+		}
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		if got := w.Header().Get("Vary"); got != tc.wantVary {
+			t.Errorf("%q, %q: got Vary %q, want %q", tc.ct, tc.accept, got, tc.wantVary)
+		}
+		wantGzip := tc.accept != "" && tc.ct != "image/png"
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != wantGzip {
+			t.Errorf("%q, %q: got gzip %v, want %v", tc.ct, tc.accept, got, wantGzip)
+		}
+	}
+}
+
+func TestWithContentTypes(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(ct string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte(content))
+		}), WithContentTypes("application/grpc-web-text", "+json"))
+	}
+	t.Run("grpc-web-text", testFunc(handler("application/grpc-web-text+proto"), true, true, content))
+	t.Run("grpc-web", testFunc(handler("application/grpc-web+proto"), true, false, content))
+	t.Run("suffix", testFunc(handler("application/ld+json; charset=utf-8"), true, true, content))
+	t.Run("text", testFunc(handler("text/plain"), true, false, content))
+}
+
+func TestDefaultContentTypes(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(ct string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte(content))
+		}), WithContentTypes(append(DefaultContentTypes(), "application/wasm")...))
+	}
+	t.Run("text", testFunc(handler("text/html; charset=utf-8"), true, true, content))
+	t.Run("json", testFunc(handler("application/json"), true, true, content))
+	t.Run("suffix", testFunc(handler("application/ld+json"), true, true, content))
+	t.Run("svg", testFunc(handler("image/svg+xml"), true, true, content))
+	t.Run("extra", testFunc(handler("application/wasm"), true, true, content))
+	t.Run("png", testFunc(handler("image/png"), true, false, content))
+	for _, s := range DefaultContentTypes() {
+		ct := s
+		switch {
+		case strings.HasSuffix(s, "/"):
+			ct = s + "plain"
+		case s[0] == '+':
+			ct = "application/vnd.example" + s
+		}
+		if !supportedContentType(ct) {
+			t.Errorf("%q from DefaultContentTypes is not supported by default", ct)
+		}
+	}
+}
+
+func TestWithContextAwareWrites(t *testing.T) {
+	for _, aware := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var writes int
+		var err error
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			for writes < 100 {
+				if writes == 10 {
+					cancel()
+				}
+				if _, err = w.Write([]byte(strings.Repeat(hello, 100))); err != nil {
+					return
+				}
+				writes++
+			}
+		})
+		h := New(inner)
+		if aware {
+			h = New(inner, WithContextAwareWrites())
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		cancel()
+		switch {
+		case aware && (writes != 10 || !errors.Is(err, context.Canceled)):
+			t.Errorf("context-aware: got %d writes, error %v; want 10 writes, %v",
+				writes, err, context.Canceled)
+		case !aware && (writes != 100 || err != nil):
+			t.Errorf("default: got %d writes, error %v; want 100 writes, no error", writes, err)
+		}
+	}
+}
+
+func TestWithErrorContext(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var ctx context.Context
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}), WithErrorContext())
+	errWrite := errors.New("write failed")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	handler.ServeHTTP(&failingWriter{header: make(http.Header), err: errWrite}, r)
+	if err := CompressionError(ctx); err != errWrite {
+		t.Fatalf("got error %v, want %v", err, errWrite)
+	}
+	serve(handler, "gzip")
+	if err := CompressionError(ctx); err != nil {
+		t.Fatalf("got error %v for successful response", err)
+	}
+}
+
+func TestWillCompress(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	precompressed, err := CompressBytes([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct{ compress, decided bool }
+	var before, after result
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		before.compress, before.decided = WillCompress(w)
+		w.Header().Set("Content-Type", "text/plain")
+		after.compress, after.decided = WillCompress(w)
+		if !after.compress {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(precompressed)
+			return
+		}
+		io.WriteString(w, content)
+	}))
+	for _, accept := range []string{"gzip", "identity"} {
+		w := serve(handler, accept)
+		// without Content-Type decision depends on body, unless client
+		// does not accept compression at all
+		if want := (result{false, accept != "gzip"}); before != want {
+			t.Errorf("%s: decision without Content-Type is %v, want %v", accept, before, want)
+		}
+		if want := (result{accept == "gzip", true}); after != want {
+			t.Errorf("%s: got %v, want %v", accept, after, want)
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("%s: got Content-Encoding %q, want gzip", accept, ce)
+		}
+		if data, err := readAllGzipped(w.Body); err != nil || string(data) != content {
+			t.Errorf("%s: read content differs from served, error: %v", accept, err)
+		}
+	}
+	if compress, decided := WillCompress(httptest.NewRecorder()); compress || !decided {
+		t.Errorf("plain ResponseWriter: got %v, %v; want false, true", compress, decided)
+	}
+}
+
+func TestWithEncodingContext(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var ctx context.Context
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		w.Write([]byte(content))
+	})
+	handler := New(inner, WithEncodingContext(), WithEncodings("deflate", "gzip"))
+	for _, tc := range []struct {
+		h            http.Handler
+		ct, accept   string
+		wantEncoding string
+	}{
+		{handler, "text/plain", "gzip", "gzip"},
+		{handler, "text/plain", "deflate, gzip", "deflate"},
+		{handler, "image/png", "gzip", "identity"},
+		{handler, "text/plain", "", "identity"},
+		{New(inner), "text/plain", "gzip", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?ct="+url.QueryEscape(tc.ct), nil)
+		if tc.accept != "" {
+			r.Header.Set(hdrAcceptEncoding, tc.accept)
+		}
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		if got := SelectedEncoding(ctx); got != tc.wantEncoding {
+			t.Errorf("%s, %q: got encoding %q, want %q", tc.ct, tc.accept, got, tc.wantEncoding)
+		}
+		if ce := w.Header().Get("Content-Encoding"); tc.wantEncoding != "" && ce != strings.TrimPrefix(tc.wantEncoding, "identity") {
+			t.Errorf("%s, %q: context encoding %q does not match Content-Encoding %q", tc.ct, tc.accept, tc.wantEncoding, ce)
+		}
+	}
+}
+
+// failingWriter is a http.ResponseWriter which Write calls fail with err
+type failingWriter struct {
+	header http.Header
+	err    error
+}
+
+func (w *failingWriter) Header() http.Header         { return w.header }
+func (w *failingWriter) Write(b []byte) (int, error) { return 0, w.err }
+func (w *failingWriter) WriteHeader(int)             {}
+
+func TestLateContentLength(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, content[:10])
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		io.WriteString(w, content[10:])
+	})
+	for _, h := range []http.Handler{New(inner), New(inner, WithMeasuredThreshold())} {
+		srv := httptest.NewServer(h)
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := readAllGzipped(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("got Content-Encoding %q, want gzip", ce)
+		}
+		if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+			t.Errorf("compressed response has Content-Length %d", resp.ContentLength)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != content {
+			t.Error("read content differs from served")
+		}
+	}
+}
+
+func TestMeasuredThresholdIgnoresContentLength(t *testing.T) {
+	small := strings.Repeat("x", compressThreshold/2)
+	large := strings.Repeat("x", compressThreshold*2)
+	handler := func(cl int, body string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(cl))
+			w.Write([]byte(body))
+		}), WithMeasuredThreshold())
+	}
+	t.Run("overstated", testFunc(handler(compressThreshold*5, small), true, false, small))
+	t.Run("understated", testFunc(handler(compressThreshold/5, large), true, true, large))
+}
+
+func TestWithUserAgentFilter(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}), WithUserAgentFilter(func(ua string) bool { return strings.Contains(ua, "BrokenAgent/1.") }))
+	for ua, want := range map[string]string{
+		"BrokenAgent/1.2 (compatible)": "",
+		"BrokenAgent/2.0":              "gzip",
+		"":                             "gzip",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if ce := w.Result().Header.Get("Content-Encoding"); ce != want {
+			t.Errorf("%q: got Content-Encoding %q, want %q", ua, ce, want)
+		}
+	}
+}
+
+func TestWithFlushPolicy(t *testing.T) {
+	t.Parallel()
+	chunk := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	run := func(policy FlushPolicy) (grown []bool) {
+		w := httptest.NewRecorder()
+		handler := New(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.Write([]byte(chunk)) // writes gzip header
+			size := w.Body.Len()
+			for i := 0; i < 4; i++ {
+				rw.Write([]byte(chunk))
+				rw.(http.Flusher).Flush()
+				grown = append(grown, w.Body.Len() > size)
+				size = w.Body.Len()
+			}
+		}), WithFlushPolicy(policy))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		handler.ServeHTTP(w, r)
+		if !w.Flushed {
+			t.Errorf("policy %d: underlying ResponseWriter was not flushed", policy)
+		}
+		if data, err := readAllGzipped(w.Body); err != nil || string(data) != strings.Repeat(chunk, 5) {
+			t.Errorf("policy %d: read content differs from served (error: %v)", policy, err)
+		}
+		return grown
+	}
+	for _, tc := range []struct {
+		policy FlushPolicy
+		want   []bool
+	}{
+		{FlushAlways, []bool{true, true, true, true}},
+		{FlushNever, []bool{false, false, false, false}},
+		{FlushThreshold(2 * len(chunk)), []bool{true, false, true, false}},
+	} {
+		if got := run(tc.policy); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("policy %d: got output growth on flushes %v, want %v", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestEmptyAcceptEncoding(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}))
+	for _, value := range []string{"", ",", " , "} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header[hdrAcceptEncoding] = []string{value}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if ce := w.Result().Header.Get("Content-Encoding"); ce != "" {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q", value, ce)
+		}
+	}
+}
+
+func TestWithContentTypeDetector(t *testing.T) {
+	const magic = "\x00MYFMT\x01"
+	content := magic + strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var gotLen int
+	detector := func(b []byte) string {
+		gotLen = len(b)
+		if strings.HasPrefix(string(b), magic) {
+			return "text/plain"
+		}
+		return http.DetectContentType(b)
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(content)) })
+	w := serve(New(inner, WithContentTypeDetector(detector)), "gzip")
+	if ct := w.Result().Header.Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("got Content-Type %q, want text/plain", ct)
+	}
+	if gotLen != 512 {
+		t.Fatalf("detector got %d bytes, want 512", gotLen)
+	}
+	t.Run("detected", testFunc(New(inner, WithContentTypeDetector(detector)), true, true, content))
+	t.Run("default", testFunc(New(inner), true, false, content))
+}
+
+func TestNegotiation(t *testing.T) {
+	t.Parallel()
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat(hello, compressThreshold/len(hello)+1)))
+	})
+	gzipOnly := New(inner)
+	both := New(inner, WithEncodings("gzip", "deflate"))
+	for _, tc := range []struct {
+		h      http.Handler
+		accept string
+		want   string
+	}{
+		{gzipOnly, "deflate, gzip", "gzip"},
+		{gzipOnly, "deflate;q=1.0, gzip;q=0.1", "gzip"},
+		{gzipOnly, "br, deflate", ""},
+		{both, "deflate, gzip", "gzip"},
+		{both, "deflate;q=0.9, gzip;q=0.9", "gzip"},
+		{both, "gzip;q=0.5, deflate", "deflate"},
+		{both, "br;q=1.0, deflate;q=0.2", "deflate"},
+		{both, "br, identity", ""},
+	} {
+		if ce := serve(tc.h, tc.accept).Result().Header.Get("Content-Encoding"); ce != tc.want {
+			t.Errorf("%q: got Content-Encoding %q, want %q", tc.accept, ce, tc.want)
+		}
+	}
+}
+
+func TestWithStrictChecks(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+		if r.URL.Query().Get("late") != "" {
+			w.Header().Set("Content-Encoding", "br")
+		}
+		w.Write([]byte(content))
+	}), WithStrictChecks())
+	run := func(target string) (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return false
+	}
+	if run("/") {
+		t.Fatal("consistent response triggered strict checks")
+	}
+	if !run("/?late=1") {
+		t.Fatal("Content-Encoding modified after commit did not trigger strict checks")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("compressed response with Content-Range did not trigger strict checks")
+			}
+		}()
+		w := httptest.NewRecorder()
+		w.Header().Set(hdrContentEncoding, "gzip")
+		w.Header().Set(hdrContentRange, "bytes 0-99/1000")
+		(&gRW{w: w, enc: &encoding{name: "gzip"}}).checkHeaders()
+	}()
+}
+
+func TestWithCompressStatusClasses(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(code int) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(code)
+			w.Write([]byte(content))
+		}), WithCompressStatusClasses(2))
+	}
+	t.Run("200", testFunc(handler(http.StatusOK), true, true, content))
+	t.Run("201", testFunc(handler(http.StatusCreated), true, true, content))
+	t.Run("404", testFunc(handler(http.StatusNotFound), true, false, content))
+	t.Run("500", testFunc(handler(http.StatusInternalServerError), true, false, content))
+	t.Run("panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithCompressStatusClasses(6) does not panic")
+			}
+		}()
+		WithCompressStatusClasses(6)
+	})
+}
+
+func TestRedirect(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(opts ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			w.Write([]byte(content))
+		}), opts...)
+	}
+	for _, tc := range []struct {
+		name     string
+		h        http.Handler
+		compress bool
+	}{
+		{"default", handler(), false},
+		{"classes", handler(WithCompressStatusClasses(3)), true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/old", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, http.StatusFound)
+		}
+		if got := w.Header().Get("Location"); got != "/new" {
+			t.Errorf("%s: got Location %q, want %q", tc.name, got, "/new")
+		}
+		if got := w.Header().Get(hdrContentEncoding) == "gzip"; got != tc.compress {
+			t.Errorf("%s: got compressed %v, want %v", tc.name, got, tc.compress)
+		}
+	}
+}
+
+func Test_gRWConn(t *testing.T) {
+	t.Parallel()
+	type connGetter interface {
+		Conn() (net.Conn, bool)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var gotConn net.Conn
+	var ok bool
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		gotConn, ok = w.(connGetter).Conn()
+		if _, err := w.Write([]byte(hello)); err != ErrWriteAfterClose {
+			t.Errorf("write after hijack got error %v, want %v", err, ErrWriteAfterClose)
+		}
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	w := &hijackableWriter{ResponseRecorder: httptest.NewRecorder(), conn: serverConn}
+	h.ServeHTTP(w, r)
+	if !ok || gotConn != serverConn {
+		t.Fatalf("Conn returned %v, %v; want hijacked connection", gotConn, ok)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatal("hijacked response has body written")
+	}
+	h = New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotConn, ok = w.(connGetter).Conn()
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if ok || gotConn != nil {
+		t.Fatalf("Conn returned %v, %v for non-hijackable writer", gotConn, ok)
+	}
+}
+
+// hijackableWriter is a http.ResponseWriter that implements http.Hijacker
+type hijackableWriter struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (w *hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+func TestDuplicateContentType(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(types ...string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, ct := range types {
+				w.Header().Add("Content-Type", ct)
+			}
+			w.Write([]byte(content))
+		}))
+	}
+	for _, tc := range []struct {
+		types []string
+		want  []string
+	}{
+		{[]string{"text/plain", "application/octet-stream"}, []string{"text/plain"}},
+		{[]string{"application/octet-stream", "text/plain"}, []string{"application/octet-stream", "text/plain"}},
+	} {
+		w := serve(handler(tc.types...), "gzip")
+		wantGzip := len(tc.want) == 1
+		if got := w.Result().Header.Get("Content-Encoding") == "gzip"; got != wantGzip {
+			t.Errorf("%q: got gzip %v, want %v", tc.types, got, wantGzip)
+		}
+		if got := w.Result().Header.Values("Content-Type"); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got Content-Type %q, want %q", tc.types, got, tc.want)
+		}
+	}
+}
+
+func TestWithEntropyGuard(t *testing.T) {
+	random := make([]byte, compressThreshold*2)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(body string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}), WithEntropyGuard(7))
+	}
+	t.Run("random", testFunc(handler(string(random)), true, false, string(random)))
+	t.Run("text", testFunc(handler(text), true, true, text))
+	t.Run("panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithEntropyGuard(9) does not panic")
+			}
+		}()
+		WithEntropyGuard(9)
+	})
+}
+
+func Test_gRWOptionalInterfaces(t *testing.T) {
+	t.Parallel()
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("ResponseWriter does not implement http.Flusher")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("ResponseWriter does not implement http.Hijacker")
+		}
+		if p, ok := w.(http.Pusher); !ok {
+			t.Error("ResponseWriter does not implement http.Pusher")
+		} else if err := p.Push("/style.css", nil); err != http.ErrNotSupported {
+			t.Errorf("Push got error %v, want %v", err, http.ErrNotSupported)
+		}
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now()); !errors.Is(err, http.ErrNotSupported) {
+			t.Errorf("SetWriteDeadline got error %v, want %v", err, http.ErrNotSupported)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if sw, ok := w.(io.StringWriter); !ok {
+			t.Error("ResponseWriter does not implement io.StringWriter")
+		} else {
+			sw.WriteString(hello)
+		}
+		if rf, ok := w.(io.ReaderFrom); !ok {
+			t.Error("ResponseWriter does not implement io.ReaderFrom")
+		} else {
+			rf.ReadFrom(strings.NewReader(hello))
+		}
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	w := &readerFromWriter{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, r)
+	if !w.readFrom {
+		t.Error("ReadFrom of the underlying ResponseWriter was not used for uncompressed response")
+	}
+	if w.Body.String() != hello+hello {
+		t.Error("read content differs from served")
+	}
+}
+
+// readerFromWriter is a http.ResponseWriter that implements io.ReaderFrom
+type readerFromWriter struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readerFromWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+func TestWithBufferHighWater(t *testing.T) {
+	const highWater = compressThreshold * 4
+	handler := func(body string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < len(body); i += 100 {
+				end := i + 100
+				if end > len(body) {
+					end = len(body)
+				}
+				w.Write([]byte(body[i:end]))
+			}
+			if len(body) < highWater && w.(*gRW).committed {
+				t.Errorf("body of %d bytes was not buffered", len(body))
+			}
+		}), WithBufferHighWater(highWater))
+	}
+	below := strings.Repeat("x", compressThreshold/2)
+	between := strings.Repeat("x", compressThreshold*2)
+	above := strings.Repeat("x", highWater*2)
+	t.Run("below threshold", testFunc(handler(below), true, false, below))
+	t.Run("between", testFunc(handler(between), true, true, between))
+	t.Run("above high water", testFunc(handler(above), true, true, above))
+}
+
+func TestWithHeaderHook(t *testing.T) {
+	t.Parallel()
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(strings.Repeat(hello, compressThreshold/len(hello)+1)))
+	}), WithHeaderHook(func(h http.Header, compressed bool) {
+		if compressed {
+			h.Set("X-Cache-Tag", "compressed-"+h.Get("Content-Encoding"))
+		}
+	}))
+	for ct, want := range map[string]string{
+		"text/plain": "compressed-gzip",
+		"image/png":  "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?type="+ct, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Result().Header.Get("X-Cache-Tag"); got != want {
+			t.Errorf("%s: got X-Cache-Tag %q, want %q", ct, got, want)
+		}
+	}
+}
+
+func TestFlushBeforeWrite(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(ct string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			for i := 0; i < 3; i++ {
+				w.(http.Flusher).Flush()
+			}
+			if g, ok := w.(*gRW); ok && !g.committed {
+				t.Error("Flush did not commit response")
+			}
+			w.Write([]byte(content))
+		}))
+	}
+	t.Run("content-type", testFunc(handler("text/plain"), true, true, content))
+	t.Run("no content-type", testFunc(handler(""), true, false, content))
+	t.Run("non-gzipped", testFunc(handler("text/plain"), false, false, content))
+}
+
+func TestWithLevelByContentType(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	words := strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor")
+	var sb strings.Builder
+	for sb.Len() < compressThreshold*50 {
+		sb.WriteString(words[rnd.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	content := sb.String()
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(content))
+	}), WithLevelByContentType(map[string]int{
+		"text/":           gzip.BestSpeed,
+		"text/html":       gzip.BestCompression,
+		"application/xml": gzip.NoCompression,
+	}))
+	sizes := make(map[string]int)
+	for _, ct := range []string{"text/html; charset=utf-8", "text/plain", "application/json"} {
+		r := httptest.NewRequest(http.MethodGet, "/?type="+url.QueryEscape(ct), nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Result().Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%s: response is not gzipped", ct)
+		}
+		sizes[ct] = w.Body.Len()
+		b, err := readAllGzipped(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", ct, err)
+		}
+		if string(b) != content {
+			t.Fatalf("%s: decompressed content differs from original", ct)
+		}
+	}
+	if html, plain := sizes["text/html; charset=utf-8"], sizes["text/plain"]; html >= plain {
+		t.Errorf("text/html compressed to %d bytes, not smaller than text/plain %d bytes", html, plain)
+	}
+	if plain, json := sizes["text/plain"], sizes["application/json"]; plain != json {
+		t.Errorf("text/plain compressed to %d bytes, application/json with default level to %d bytes", plain, json)
+	}
+	t.Run("panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithLevelByContentType with invalid level does not panic")
+			}
+		}()
+		WithLevelByContentType(map[string]int{"text/html": 42})
+	})
+}
+
+func TestWithLevelProvider(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)*10)
+	levels := []int{gzip.NoCompression, gzip.BestCompression, 42, gzip.NoCompression}
+	var calls int
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, content)
+	}), WithLevelProvider(func() int {
+		level := levels[calls%len(levels)]
+		calls++
+		return level
+	}))
+	var sizes []int
+	for range levels {
+		w := serve(h, "gzip")
+		sizes = append(sizes, w.Body.Len())
+		if data, err := readAllGzipped(w.Body); err != nil || string(data) != content {
+			t.Fatalf("read content differs from served, error: %v", err)
+		}
+	}
+	if sizes[0] <= len(content) {
+		t.Errorf("got %d bytes with no compression, want more than %d", sizes[0], len(content))
+	}
+	if sizes[1] >= sizes[0] || sizes[2] >= sizes[0] {
+		t.Errorf("compressed sizes %v do not depend on provided level", sizes)
+	}
+	if sizes[3] != sizes[0] {
+		t.Errorf("same level gave different sizes %d and %d", sizes[0], sizes[3])
+	}
+	typed := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, content)
+	}), WithLevel(gzip.BestSpeed), WithLevelByContentType(map[string]int{"text/html": gzip.BestSpeed}),
+		WithLevelProvider(func() int { return gzip.NoCompression }))
+	if w := serve(typed, "gzip"); w.Body.Len() >= len(content) {
+		t.Errorf("got %d bytes for type with its own level, want less than %d", w.Body.Len(), len(content))
+	}
+	if _, err := NewChecked(http.NotFoundHandler(), WithLevelProvider(func() int { return 1 }),
+		WithWriterPool(&freshWriters{})); err == nil {
+		t.Error("NewChecked accepted WithLevelProvider with WithWriterPool")
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	t.Parallel()
+	html := "<!doctype html><title>test</title>" + strings.Repeat("<p>"+hello+"</p>", compressThreshold/len(hello)+1)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, compressThreshold*2)...)
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte(html)},
+		"image.png":  {Data: png},
+	}
+	jsonBody := `{"items":[` + strings.Repeat(`"`+hello+`",`, compressThreshold/len(hello)+1) + `""]}`
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(fsys))))
+	mux.HandleFunc("/api/items", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, jsonBody)
+	})
+	srv := httptest.NewServer(New(mux))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path     string
+		code     int
+		wantGzip bool
+		want     string
+	}{
+		{"/static/index.html", http.StatusOK, true, html},
+		{"/static/image.png", http.StatusOK, false, string(png)},
+		{"/api/items", http.StatusOK, true, jsonBody},
+		{"/missing", http.StatusNotFound, false, "404 page not found\n"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.path, resp.StatusCode, tc.code)
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: got Vary %q, want Accept-Encoding", tc.path, got)
+		}
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.path, got, tc.wantGzip)
+			continue
+		}
+		if tc.wantGzip {
+			if resp.ContentLength != -1 {
+				t.Errorf("%s: compressed response has Content-Length %d", tc.path, resp.ContentLength)
+			}
+			if body, err = readAllGzipped(bytes.NewReader(body)); err != nil {
+				t.Errorf("%s: %v", tc.path, err)
+				continue
+			}
+		}
+		if string(body) != tc.want {
+			t.Errorf("%s: response body differs from original", tc.path)
+		}
+	}
+}
+
+//go:embed testdata/static
+var staticFS embed.FS
+
+func TestEmbedFS(t *testing.T) {
+	t.Parallel()
+	fsys := http.FileServer(http.FS(staticFS))
+	for _, tc := range []struct {
+		name string
+		h    http.Handler
+	}{
+		{"default", New(fsys)},
+		{"exact", New(fsys, WithExactContentTypes("text/html", "text/css",
+			"text/javascript", "application/javascript", "image/svg+xml"))},
+	} {
+		for _, name := range []string{"page.html", "style.css", "app.js", "icon.svg", "image.png", "photo.jpg"} {
+			want, err := staticFS.ReadFile("testdata/static/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/testdata/static/"+name, nil)
+			r.Header.Set(hdrAcceptEncoding, "gzip")
+			w := httptest.NewRecorder()
+			tc.h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: got status %d", tc.name, name, w.Code)
+			}
+			wantGzip := !strings.HasSuffix(name, ".png") && !strings.HasSuffix(name, ".jpg")
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != wantGzip {
+				t.Errorf("%s %s (%s): got gzip %v, want %v", tc.name, name,
+					w.Header().Get("Content-Type"), got, wantGzip)
+				continue
+			}
+			body := w.Body.Bytes()
+			if wantGzip {
+				if body, err = readAllGzipped(w.Body); err != nil {
+					t.Errorf("%s %s: %v", tc.name, name, err)
+					continue
+				}
+			}
+			if !bytes.Equal(body, want) {
+				t.Errorf("%s %s: response body differs from original", tc.name, name)
+			}
+		}
+	}
+}
+
+func TestProxyHandoff(t *testing.T) {
+	handler := func(header string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			if header != "" {
+				w.Header().Set(header, "/protected/file.html")
+			}
+			w.WriteHeader(http.StatusOK)
+		}), options...)
+	}
+	for _, tc := range []struct {
+		name     string
+		h        http.Handler
+		wantGzip bool
+	}{
+		{"X-Accel-Redirect", handler("X-Accel-Redirect"), false},
+		{"custom header", handler("X-Sendfile", WithProxyHandoffHeader("x-sendfile")), false},
+		{"custom header ignores default", handler("X-Accel-Redirect", WithProxyHandoffHeader("X-Sendfile")), true},
+		{"disabled", handler("X-Accel-Redirect", WithProxyHandoffHeader("")), true},
+		{"no header", handler(""), true},
+	} {
+		w := serve(tc.h, "gzip")
+		if got := w.Result().Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+		}
+		if !tc.wantGzip && w.Body.Len() != 0 {
+			t.Errorf("%s: got %d bytes of body, want none", tc.name, w.Body.Len())
+		}
+	}
+}
+
+func TestWithReprDigest(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var rec *httptest.ResponseRecorder
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		io.WriteString(w, content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		if w.Header().Get("Content-Encoding") == "gzip" && rec.Flushed {
+			t.Error("compressed response was flushed before it was complete")
+		}
+		io.WriteString(w, content[len(content)/2:])
+	}), WithReprDigest(), WithStrictChecks())
+
+	r := httptest.NewRequest(http.MethodGet, "/?type=text/plain", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	resp := rec.Result()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("response is not gzipped")
+	}
+	sum := sha256.Sum256(rec.Body.Bytes())
+	if got, want := resp.Header.Get("Repr-Digest"), "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":"; got != want {
+		t.Errorf("got Repr-Digest %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+		t.Errorf("got Content-Length %q, want %q", got, want)
+	}
+	if b, err := readAllGzipped(rec.Body); err != nil || string(b) != content {
+		t.Errorf("decompressed content differs from original, error: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?type=image/png", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if got := rec.Result().Header.Get("Repr-Digest"); got != "" {
+		t.Errorf("uncompressed response has Repr-Digest %q", got)
+	}
+	if rec.Body.String() != content {
+		t.Error("uncompressed response body differs from original")
+	}
+}
+
+func TestCompressBytes(t *testing.T) {
+	t.Parallel()
+	data := []byte(strings.Repeat(hello, 100))
+	for _, options := range [][]Option{nil, {WithLevel(gzip.BestCompression)}} {
+		b, err := CompressBytes(data, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) >= len(data) {
+			t.Errorf("compressed size %d is not smaller than original %d", len(b), len(data))
+		}
+		got, err := readAllGzipped(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("decompressed data differs from original")
+		}
+	}
+}
+
+func TestEmptyInitialWrite(t *testing.T) {
+	content := `{"items":[` + strings.Repeat(`"`+hello+`",`, compressThreshold/len(hello)+1) + `""]}`
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(nil)
+		w.Write([]byte{})
+		w.WriteHeader(http.StatusNotFound) // superfluous, status is fixed by Write
+		io.WriteString(w, content)
+	}), WithContentTypeDetector(func(b []byte) string {
+		if len(b) != 0 && b[0] == '{' {
+			return "application/json"
+		}
+		return http.DetectContentType(b)
+	}))
+	w := serve(h, "gzip")
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", ce)
+	}
+	if data, err := readAllGzipped(w.Body); err != nil || string(data) != content {
+		t.Fatalf("read content differs from served, error: %v", err)
+	}
+}
+
+func TestWithObserver(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	for _, ct := range []string{"text/plain", "image/png"} {
+		var stats CompressionStats
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			for b := []byte(content); len(b) != 0; {
+				n := 100
+				if n > len(b) {
+					n = len(b)
+				}
+				w.Write(b[:n])
+				b = b[n:]
+			}
+		}), WithObserver(func(s CompressionStats) { stats = s }))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := &shortWriter{ResponseRecorder: httptest.NewRecorder(), max: 50}
+		handler.ServeHTTP(w, r)
+		if got, want := stats.BytesOut, int64(w.Body.Len()); got != want {
+			t.Errorf("%s: observer got BytesOut %d, want %d", ct, got, want)
+		}
+		wantEncoding := ""
+		if ct == "text/plain" {
+			wantEncoding = "gzip"
+		} else if got, want := stats.BytesIn, int64(w.Body.Len()); got != want {
+			t.Errorf("%s: observer got BytesIn %d, want %d", ct, got, want)
+		}
+		if stats.Encoding != wantEncoding {
+			t.Errorf("%s: observer got Encoding %q, want %q", ct, stats.Encoding, wantEncoding)
+		}
+	}
+	t.Run("not accepted", func(t *testing.T) {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, content) })
+		for _, opt := range []Option{WithVaryOnlyForTypes("text/plain"), WithHintHeader("X-Compress")} {
+			var calls int
+			serve(New(inner, opt, WithObserver(func(CompressionStats) { calls++ })), "")
+			if calls != 0 {
+				t.Errorf("observer called %d times for request not accepting gzip", calls)
+			}
+		}
+	})
+}
+
+func TestObserverTTFBDelay(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	const delay = 20 * time.Millisecond
+	var stats CompressionStats
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		io.WriteString(w, content[:100])
+		time.Sleep(delay)
+		io.WriteString(w, content[100:])
+	}), WithObserver(func(s CompressionStats) { stats = s }), WithMeasuredThreshold())
+	serve(handler, "gzip")
+	if stats.Encoding != "gzip" || stats.TTFBDelay < delay {
+		t.Errorf("got encoding %q, TTFBDelay %v; want gzip and at least %v", stats.Encoding, stats.TTFBDelay, delay)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if stats.TTFBDelay != 0 {
+		t.Errorf("response without body got TTFBDelay %v", stats.TTFBDelay)
+	}
+}
+
+// shortWriter is a http.ResponseWriter which writes at most max bytes per
+// Write call
+type shortWriter struct {
+	*httptest.ResponseRecorder
+	max int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) <= w.max {
+		return w.ResponseRecorder.Write(b)
+	}
+	n, _ := w.ResponseRecorder.Write(b[:w.max])
+	return n, io.ErrShortWrite
+}
+
+func TestWithHTTP10Buffering(t *testing.T) {
+	t.Parallel()
+	small := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	large := strings.Repeat(small, 10)
+	handler := func(body string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, body[:len(body)/2])
+			io.WriteString(w, body[len(body)/2:])
+		}), options...)
+	}
+	for _, tc := range []struct {
+		name       string
+		h          http.Handler
+		proto      string
+		body       string
+		wantGzip   bool
+		wantLength bool
+	}{
+		{"buffered", handler(small, WithHTTP10Buffering(len(small))), "HTTP/1.0", small, true, true},
+		{"over limit", handler(large, WithHTTP10Buffering(len(small))), "HTTP/1.0", large, false, false},
+		{"HTTP/1.1", handler(small, WithHTTP10Buffering(len(small))), "HTTP/1.1", small, true, false},
+		{"no buffering", handler(small), "HTTP/1.0", small, true, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Proto = tc.proto
+		r.ProtoMajor, r.ProtoMinor, _ = http.ParseHTTPVersion(tc.proto)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		resp := w.Result()
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+			continue
+		}
+		cl := resp.Header.Get("Content-Length")
+		if tc.wantLength && cl != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("%s: got Content-Length %q for %d bytes of body", tc.name, cl, w.Body.Len())
+		} else if !tc.wantLength && cl != "" {
+			t.Errorf("%s: got unexpected Content-Length %q", tc.name, cl)
+		}
+		body := w.Body.Bytes()
+		if tc.wantGzip {
+			var err error
+			if body, err = readAllGzipped(w.Body); err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+				continue
+			}
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: response body differs from original", tc.name)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("id,name,value\n")
+	for i := 0; sb.Len() < compressThreshold*10; i++ {
+		fmt.Fprintf(&sb, "%d,item %d,%d\n", i, i, i*i)
+	}
+	content := sb.String()
+	handler := func(ct string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte(content))
+		}), options...)
+	}
+	t.Run("text/csv", testFunc(handler("text/csv; charset=utf-8"), true, true, content))
+	t.Run("text/tab-separated-values", testFunc(handler("text/tab-separated-values"), true, true, content))
+	t.Run("application/csv", testFunc(handler("application/csv"), true, false, content))
+	t.Run("application/csv enabled", testFunc(handler("application/csv", WithContentTypes("application/csv")), true, true, content))
+}
+
+func TestWithLogger(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		io.WriteString(w, content)
+	}), WithLogger(logger))
+	errWrite := errors.New("write failed")
+	for _, tc := range []struct {
+		ct   string
+		w    http.ResponseWriter
+		want []map[string]interface{}
+	}{
+		{"text/plain", httptest.NewRecorder(), []map[string]interface{}{{
+			"level": "DEBUG", "encoding": "gzip", "content_type": "text/plain", "skipped": false,
+			"reason": "", "bytes_in": float64(len(content)),
+		}}},
+		{"image/png", httptest.NewRecorder(), []map[string]interface{}{{
+			"level": "DEBUG", "encoding": "", "content_type": "image/png", "skipped": true,
+			"reason": "content type", "bytes_in": float64(len(content)), "bytes_out": float64(len(content)),
+		}}},
+		{"text/plain", &failingWriter{header: make(http.Header), err: errWrite}, []map[string]interface{}{
+			{"level": "WARN", "encoding": "gzip", "error": errWrite.Error()},
+			{"level": "DEBUG", "encoding": "gzip", "skipped": false},
+		}},
+	} {
+		buf.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/?ct="+url.QueryEscape(tc.ct), nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		handler.ServeHTTP(tc.w, r)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != len(tc.want) {
+			t.Fatalf("%s: got %d log records, want %d:\n%s", tc.ct, len(lines), len(tc.want), buf.String())
+		}
+		for i, line := range lines {
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.want[i] {
+				if rec[k] != v {
+					t.Errorf("%s: record %d has %s=%v, want %v", tc.ct, i, k, rec[k], v)
+				}
+			}
+		}
+	}
+	buf.Reset()
+	w := serve(handler, "gzip")
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["bytes_out"] != float64(w.Body.Len()) {
+		t.Errorf("got bytes_out %v, want %d", rec["bytes_out"], w.Body.Len())
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, content)
+	})
+	for _, tc := range []struct {
+		name     string
+		opt      Option
+		encoding string
+		reason   string
+	}{
+		{"token", WithContentEncodingToken("x-gzip"), "gzip", ""},
+		{"user agent", WithUserAgentFilter(func(string) bool { return true }), "", "user agent"},
+		{"sample rate", WithSampleRate(0), "", "sample rate"},
+	} {
+		buf.Reset()
+		serve(New(inner, tc.opt, WithLogger(logger)), "gzip")
+		var rec map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if rec["encoding"] != tc.encoding || rec["reason"] != tc.reason {
+			t.Errorf("%s: got encoding %v, reason %v; want %q, %q", tc.name, rec["encoding"], rec["reason"], tc.encoding, tc.reason)
+		}
+	}
+}
+
+func TestObserverSniffed(t *testing.T) {
+	t.Parallel()
+	// bytes that http.DetectContentType does not consider binary
+	binary := make([]byte, compressThreshold*2)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range binary {
+		binary[i] = byte(0x80 + rnd.Intn(0x80))
+	}
+	for _, ct := range []string{"", "application/json"} {
+		var stats CompressionStats
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			w.Write(binary)
+		}), WithObserver(func(s CompressionStats) { stats = s }))
+		serve(handler, "gzip")
+		wantType, wantSniffed := ct, false
+		if ct == "" {
+			wantType, wantSniffed = "text/plain; charset=utf-8", true
+		}
+		if stats.ContentType != wantType || stats.Sniffed != wantSniffed {
+			t.Errorf("declared %q: observer got ContentType %q, Sniffed %v, want %q, %v",
+				ct, stats.ContentType, stats.Sniffed, wantType, wantSniffed)
+		}
+		if stats.Encoding != "gzip" {
+			t.Errorf("declared %q: observer got Encoding %q, want gzip", ct, stats.Encoding)
+		}
+	}
+}
+
+func TestWithHonorPreference(t *testing.T) {
+	t.Parallel()
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat(hello, compressThreshold/len(hello)+1)))
+	})
+	lenient := New(inner)
+	honoring := New(inner, WithHonorPreference(), WithEncodings("gzip", "deflate"))
+	for _, tc := range []struct {
+		h      http.Handler
+		accept string
+		want   string
+	}{
+		{lenient, "identity;q=1.0, gzip;q=0.5", "gzip"},
+		{honoring, "identity;q=1.0, gzip;q=0.5", ""},
+		{honoring, "identity, gzip", ""},
+		{honoring, "gzip;q=0.5, identity;q=0.5", ""},
+		{honoring, "gzip, identity;q=0.5", "gzip"},
+		{honoring, "identity;q=0.5, deflate;q=0.8, gzip;q=0.2", "deflate"},
+		{honoring, "gzip", "gzip"},
+		{honoring, "gzip, identity;q=0", "gzip"},
+	} {
+		if ce := serve(tc.h, tc.accept).Result().Header.Get("Content-Encoding"); ce != tc.want {
+			t.Errorf("%q: got Content-Encoding %q, want %q", tc.accept, ce, tc.want)
+		}
+	}
+}
+
+func TestInspector(t *testing.T) {
+	inner := http.NotFoundHandler()
+	for _, tc := range []struct {
+		h         http.Handler
+		level     int
+		threshold int
+	}{
+		{New(inner), gzip.BestSpeed, compressThreshold},
+		{New(inner, WithLevel(gzip.BestCompression), WithThreshold(10)), gzip.BestCompression, 10},
+		{NewWithConfig(inner, NewConfig(WithThreshold(0))), gzip.BestSpeed, 0},
+	} {
+		in, ok := tc.h.(Inspector)
+		if !ok {
+			t.Fatal("handler does not implement Inspector")
+		}
+		if in.Level() != tc.level || in.Threshold() != tc.threshold {
+			t.Errorf("got level %d, threshold %d, want %d, %d",
+				in.Level(), in.Threshold(), tc.level, tc.threshold)
+		}
+	}
+}
+
+func TestSetDefaultLevel(t *testing.T) {
+	defer SetDefaultLevel(gzip.BestSpeed)
+	SetDefaultLevel(gzip.DefaultCompression)
+	if got := New(http.NotFoundHandler()).(Inspector).Level(); got != gzip.DefaultCompression {
+		t.Errorf("got level %d, want %d", got, gzip.DefaultCompression)
+	}
+	if got := New(http.NotFoundHandler(), WithLevel(gzip.BestCompression)).(Inspector).Level(); got != gzip.BestCompression {
+		t.Errorf("WithLevel: got level %d, want %d", got, gzip.BestCompression)
+	}
+	content := []byte(strings.Repeat(hello, 100))
+	want, err := CompressBytes(content, WithLevel(gzip.DefaultCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CompressBytes(content); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("CompressBytes does not use default level, error: %v", err)
+	}
+	if c := baseConfig(); c != baseConfig() || c.g.level != gzip.DefaultCompression {
+		t.Error("default configuration is not reused after SetDefaultLevel")
+	}
+	var got, ref frame
+	for _, tc := range []struct {
+		f *frame
+		c *Config
+	}{{&got, nil}, {&ref, NewConfig(WithLevel(gzip.DefaultCompression))}} {
+		tc.f.header = http.Header{"Content-Type": {"text/plain"}}
+		w := NewWriter(tc.f, tc.c)
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got.Len() >= len(content) || !bytes.Equal(got.Bytes(), ref.Bytes()) {
+		t.Error("NewWriter with nil config does not use default level")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("SetDefaultLevel(42) does not panic")
+			}
+		}()
+		SetDefaultLevel(42)
+	}()
+}
+
+func TestWithThreshold(t *testing.T) {
+	content := strings.Repeat(hello, 5)
+	handler := func(options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content))
+		}), options...)
+	}
+	t.Run("default", testFunc(handler(), true, false, content))
+	t.Run("lowered", testFunc(handler(WithThreshold(len(content))), true, true, content))
+	t.Run("measured", testFunc(handler(WithThreshold(len(content)+1), WithMeasuredThreshold()), true, false, content))
+}
+
+func TestOptions(t *testing.T) {
+	preset := Options(WithLevel(gzip.BestCompression), WithThreshold(10))
+	for _, h := range []http.Handler{
+		New(http.NotFoundHandler(), preset),
+		New(http.NotFoundHandler(), WithThreshold(20), preset),
+	} {
+		in := h.(Inspector)
+		if in.Level() != gzip.BestCompression || in.Threshold() != 10 {
+			t.Errorf("got level %d, threshold %d, want %d, %d",
+				in.Level(), in.Threshold(), gzip.BestCompression, 10)
+		}
+	}
+	in := New(http.NotFoundHandler(), preset, WithThreshold(20)).(Inspector)
+	if in.Threshold() != 20 {
+		t.Errorf("option after preset: got threshold %d, want 20", in.Threshold())
+	}
+}
+
+func TestWithAlwaysCompressTypes(t *testing.T) {
+	content := `{"metrics":[` + strings.Repeat(`1,`, 40) + `1]}`
+	if len(content) >= compressThreshold {
+		t.Fatal("content is not below compression threshold")
+	}
+	handler := func(ct string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content))
+		}), options...)
+	}
+	always := WithAlwaysCompressTypes("application/json")
+	t.Run("default", testFunc(handler("application/json"), true, false, content))
+	t.Run("forced", testFunc(handler("application/json; charset=utf-8", always), true, true, content))
+	t.Run("measured", testFunc(handler("application/json", always, WithMeasuredThreshold()), true, true, content))
+	t.Run("other", testFunc(handler("text/plain", always), true, false, content))
+	html := "<!DOCTYPE html><html><body>" + strings.Repeat("<p>hello</p>", 15) + "</body></html>"
+	sniffed := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, html)
+	}), WithAlwaysCompressTypes("text/html"), WithMeasuredThreshold())
+	t.Run("sniffed", testFunc(sniffed, true, true, html))
+}
+
+func TestWithSampleRate(t *testing.T) {
+	t.Parallel()
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat(hello, compressThreshold/len(hello)+1)))
+	})
+	const n = 2000
+	for _, tc := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.5, n * 4 / 10, n * 6 / 10},
+		{1, n, n},
+	} {
+		h := New(inner, WithSampleRate(tc.rate))
+		var compressed int
+		for i := 0; i < n; i++ {
+			resp := serve(h, "gzip").Result()
+			if resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Fatalf("rate %v: response has no Vary: Accept-Encoding header", tc.rate)
+			}
+			if resp.Header.Get("Content-Encoding") == "gzip" {
+				compressed++
+			}
+		}
+		if compressed < tc.min || compressed > tc.max {
+			t.Errorf("rate %v: %d of %d responses compressed, want from %d to %d",
+				tc.rate, compressed, n, tc.min, tc.max)
+		}
+	}
+	t.Run("panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithSampleRate(1.5) does not panic")
+			}
+		}()
+		WithSampleRate(1.5)
+	})
+}
+
+func TestWithMinQuality(t *testing.T) {
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat(hello, compressThreshold/len(hello)+1)))
+	}), WithMinQuality(0.5))
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"gzip;q=0.1", ""},
+		{"gzip;q=0.5", "gzip"},
+		{"gzip;q=1.0", "gzip"},
+	} {
+		if ce := serve(h, tc.accept).Result().Header.Get("Content-Encoding"); ce != tc.want {
+			t.Errorf("%q: got Content-Encoding %q, want %q", tc.accept, ce, tc.want)
+		}
+	}
+	for _, q := range []float64{0, -1, 1.5} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("WithMinQuality(%v) does not panic", q)
+				}
+			}()
+			WithMinQuality(q)
+		}()
+	}
+}
+
+func TestReadFromContentLength(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)*10)
+	name := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if ct := r.URL.Query().Get("type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			t.Error(err)
+		}
+	}))
+	for _, ct := range []string{"", "application/octet-stream"} {
+		r := httptest.NewRequest(http.MethodGet, "/?type="+ct, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := &readerFromWriter{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(w, r)
+		resp := w.Result()
+		if ct != "" {
+			if resp.Header.Get("Content-Encoding") != "" || !w.readFrom || w.Body.String() != content {
+				t.Errorf("%s: response was not copied as is with ReadFrom", ct)
+			}
+			continue
+		}
+		if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("got Content-Type %q, want it detected as text/plain", got)
+		}
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatal("response is not gzipped")
+		}
+		if cl := resp.Header.Get("Content-Length"); cl != "" {
+			t.Errorf("compressed response has Content-Length %s", cl)
+		}
+		if w.readFrom {
+			t.Error("ReadFrom of the underlying ResponseWriter was used for compressed response")
+		}
+		if b, err := readAllGzipped(w.Body); err != nil || string(b) != content {
+			t.Errorf("decompressed content differs from original, error: %v", err)
+		}
+	}
+}
+
+func TestWithoutContentTypeDetection(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(content))
+		}), options...)
+	}
+	t.Run("detection", testFunc(handler(), true, true, content))
+	t.Run("no detection", testFunc(handler(WithoutContentTypeDetection()), true, false, content))
+	t.Run("measured", testFunc(handler(WithoutContentTypeDetection(), WithMeasuredThreshold()), true, false, content))
+}
+
+func TestWithExtensionDetection(t *testing.T) {
+	// leading control byte makes body detected as application/octet-stream
+	content := "\x01" + strings.Repeat("body { color: #333; }\n", compressThreshold/20)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	})
+	for _, tc := range []struct {
+		h        http.Handler
+		path     string
+		wantGzip bool
+		wantType string
+	}{
+		{New(inner), "/style.css", false, "application/octet-stream"},
+		{New(inner, WithExtensionDetection()), "/style.css", true, "text/css; charset=utf-8"},
+		{New(inner, WithExtensionDetection()), "/image.png", false, "image/png"},
+		{New(inner, WithExtensionDetection()), "/data", false, "application/octet-stream"},
+		{New(inner, WithExtensionDetection(), WithoutContentTypeDetection()), "/style.css", true, "text/css; charset=utf-8"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.path, got, tc.wantGzip)
+		}
+		// compare media types only, as parameters depend on system MIME tables
+		if got := w.Header().Get("Content-Type"); mediaType(got) != mediaType(tc.wantType) {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.path, got, tc.wantType)
+		}
+	}
+}
+
+func TestWithSkipOnSetCookie(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(cookie bool, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			if cookie {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+			}
+			w.Write([]byte(content))
+		}), options...)
+	}
+	t.Run("default", testFunc(handler(true), true, true, content))
+	t.Run("cookie", testFunc(handler(true, WithSkipOnSetCookie()), true, false, content))
+	t.Run("no cookie", testFunc(handler(false, WithSkipOnSetCookie()), true, true, content))
+}
+
+func TestWithSkipRule(t *testing.T) {
+	content := `{"items":[` + strings.Repeat(`"`+hello+`",`, compressThreshold/len(hello)+1) + `""]}`
+	var calls int
+	rule := WithSkipRule(func(status int, h http.Header) bool {
+		calls++
+		return status == http.StatusCreated && mediaType(h.Get("Content-Type")) == "application/json"
+	})
+	handler := func(code int, ct string) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Header().Set("Location", "/items/1")
+			w.WriteHeader(code)
+			w.Write([]byte(content))
+		}), rule)
+	}
+	for _, tc := range []struct {
+		code     int
+		ct       string
+		wantGzip bool
+	}{
+		{http.StatusCreated, "application/json; charset=utf-8", false},
+		{http.StatusOK, "application/json", true},
+		{http.StatusCreated, "text/plain", true},
+	} {
+		w := serve(handler(tc.code, tc.ct), "gzip")
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%d %s: got gzip %v, want %v", tc.code, tc.ct, got, tc.wantGzip)
+		}
+	}
+	calls = 0
+	serve(handler(http.StatusCreated, "image/png"), "gzip")
+	if calls != 0 {
+		t.Error("skip rule called for response excluded by built-in rules")
+	}
+}
+
+func TestWithReflectionGuard(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Query().Get("q") != "" {
+			w.Header().Set("X-Has-Secret", "1")
+		}
+		w.Write([]byte(content))
+	}), WithReflectionGuard(func(r *http.Request, h http.Header) bool {
+		return r.URL.RawQuery != "" && h.Get("X-Has-Secret") != ""
+	}))
+	for _, tc := range []struct {
+		url      string
+		wantGzip bool
+	}{
+		{"/", true},
+		{"/?q=search", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Result().Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.url, got, tc.wantGzip)
+		}
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	srv := httptest.NewServer(New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content))
+	})))
+	defer srv.Close()
+	var hints []int
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, code)
+			if ce := header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("informational response has Content-Encoding %q", ce)
+			}
+			return nil
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(hints) != 1 || hints[0] != http.StatusEarlyHints {
+		t.Errorf("got informational responses %v, want single 103", hints)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("response is not gzipped")
+	}
+	if b, err := readAllGzipped(resp.Body); err != nil || string(b) != content {
+		t.Errorf("decompressed content differs from original, error: %v", err)
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(ct, contentRange string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			if contentRange != "" {
+				w.Header().Set("Content-Range", contentRange)
+			}
+			w.Write([]byte(content))
+		}), options...)
+	}
+	enabled := WithContentTypes("multipart/mixed")
+	t.Run("default", testFunc(handler("multipart/mixed; boundary=xyz", ""), true, false, content))
+	t.Run("enabled", testFunc(handler("multipart/mixed; boundary=xyz", "", enabled), true, true, content))
+	t.Run("other subtype", testFunc(handler("multipart/byteranges; boundary=xyz", "", enabled), true, false, content))
+	t.Run("content-range", testFunc(handler("multipart/mixed; boundary=xyz", "bytes 0-99/1000", enabled), true, false, content))
+}
+
+func TestWithWriterPool(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	var want bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&want, gzip.BestCompression)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	src := &freshWriters{level: gzip.BestCompression}
+	c := NewConfig(WithWriterPool(src), WithEncodings("gzip", "deflate"))
+	resetPools(c)
+	handler := NewWithConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}), c)
+	for i := 0; i < 2; i++ {
+		w := serve(handler, "gzip")
+		if !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+			t.Fatal("compressed body differs from the one produced by writer from pool")
+		}
+	}
+	if src.gets != 2 || src.puts != 2 {
+		t.Errorf("pool got %d Get and %d Put calls, want 2 each", src.gets, src.puts)
+	}
+	if w := serve(handler, "deflate"); w.Result().Header.Get("Content-Encoding") != "deflate" {
+		t.Error("deflate response is not compressed")
+	}
+	if src.gets != 2 {
+		t.Error("writer pool was used for deflate coding")
+	}
+}
+
+// freshWriters is a WriterPool that creates new writer for each Get call
+type freshWriters struct {
+	level      int
+	gets, puts int
+}
+
+func (p *freshWriters) Get() *gzip.Writer {
+	p.gets++
+	w, err := gzip.NewWriterLevel(io.Discard, p.level)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+func (p *freshWriters) Put(*gzip.Writer) { p.puts++ }
+
+func TestWithThresholdPerType(t *testing.T) {
+	t.Parallel()
+	content := `{"items":[` + strings.Repeat(`"item",`, 26) + `"last"]}`
+	if len(content) != 200 {
+		t.Fatalf("content is %d bytes, want 200", len(content))
+	}
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content))
+	}), WithThresholdPerType(map[string]int{"application/json": 100}))
+	for _, tc := range []struct {
+		ct       string
+		wantGzip bool
+	}{
+		{"application/json", true},
+		{"text/plain", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?type="+tc.ct, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		resp := w.Result()
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.ct, got, tc.wantGzip)
+		}
+		cl := resp.Header.Get("Content-Length")
+		if tc.wantGzip && cl != "" {
+			t.Errorf("%s: compressed response has Content-Length %s", tc.ct, cl)
+		} else if !tc.wantGzip && cl != strconv.Itoa(len(content)) {
+			t.Errorf("%s: got Content-Length %q, want %d", tc.ct, cl, len(content))
+		}
+	}
+	html := "<!DOCTYPE html><html><body>" + strings.Repeat("<p>hello</p>", 15) + "</body></html>"
+	sniffed := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, html)
+	}), WithMeasuredThreshold(), WithThresholdPerType(map[string]int{"text/html": 50}))
+	t.Run("sniffed", testFunc(sniffed, true, true, html))
+}
+
+func TestBufferedHandlerWrites(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)*5)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		bw := bufio.NewWriterSize(w, 4096)
+		for i := 0; i < len(content); i += len(hello) {
+			bw.WriteString(content[i : i+len(hello)])
+		}
+		if bw.Buffered() == 0 {
+			t.Error("no data is left in handler buffer before final flush")
+		}
+		if err := bw.Flush(); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Run("gzipped", testFunc(handler, true, true, content))
+	t.Run("non-gzipped", testFunc(handler, false, false, content))
+}
+
+func TestWithContentEncodingToken(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}), WithContentEncodingToken("x-gzip"), WithStrictChecks())
+	w := serve(handler, "gzip")
+	if ce := w.Result().Header.Get("Content-Encoding"); ce != "x-gzip" {
+		t.Fatalf("got Content-Encoding %q, want x-gzip", ce)
+	}
+	if b, err := readAllGzipped(w.Body); err != nil || string(b) != content {
+		t.Errorf("decompressed content differs from original, error: %v", err)
+	}
+}
+
+func TestWithCDNMode(t *testing.T) {
+	content := strings.Repeat("x", 2048)
+	handler := func(cacheControl string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.Write([]byte(content))
+		}), options...)
+	}
+	cdn := WithCDNMode(8192)
+	t.Run("cacheable", testFunc(handler("public, max-age=3600"), true, true, content))
+	t.Run("cacheable cdn", testFunc(handler("public, max-age=3600", cdn), true, false, content))
+	t.Run("s-maxage cdn", testFunc(handler("S-MaxAge=60", cdn), true, false, content))
+	t.Run("private cdn", testFunc(handler("private, max-age=3600", cdn), true, true, content))
+	t.Run("no-store cdn", testFunc(handler("no-store", cdn), true, true, content))
+	t.Run("uncacheable cdn", testFunc(handler("", cdn), true, true, content))
+	t.Run("measured cdn", testFunc(handler("public", cdn, WithMeasuredThreshold()), true, false, content))
+}
+
+func TestWithExactContentTypes(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := func(ct string, options ...Option) http.Handler {
+		return New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte(content))
+		}), options...)
+	}
+	exact := WithExactContentTypes("Application/JSON")
+	t.Run("json", testFunc(handler("application/json; charset=utf-8", exact), true, true, content))
+	t.Run("html", testFunc(handler("text/html", exact), true, false, content))
+	t.Run("json-seq", testFunc(handler("application/json-seq", exact), true, false, content))
+	t.Run("suffix", testFunc(handler("application/ld+json", exact), true, false, content))
+	t.Run("last wins", testFunc(handler("text/html", exact, WithContentTypes("text/")), true, true, content))
+}
+
+func TestNewChecked(t *testing.T) {
+	detector := func([]byte) string { return "text/plain" }
+	for _, tc := range []struct {
+		options []Option
+		want    string // substring of error, empty if no error expected
+	}{
+		{nil, ""},
+		{[]Option{WithLevel(gzip.BestCompression), WithContentTypes("text/")}, ""},
+		{[]Option{WithContentTypeDetector(detector), WithoutContentTypeDetection()},
+			"WithContentTypeDetector and WithoutContentTypeDetection"},
+		{[]Option{WithContentTypes("text/"), WithExactContentTypes("text/html")},
+			"WithContentTypes and WithExactContentTypes"},
+		{[]Option{WithLevel(gzip.BestSpeed), WithWriterPool(&freshWriters{})},
+			"WithWriterPool and WithLevel"},
+		{[]Option{WithWriterPool(&freshWriters{}), WithLevelByContentType(map[string]int{"text/": 9})},
+			"WithWriterPool and WithLevelByContentType"},
+	} {
+		h, err := NewChecked(http.NotFoundHandler(), tc.options...)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("unexpected error: %v", err)
+		case tc.want == "" && h == nil:
+			t.Error("got nil handler without error")
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("got error %v, want one mentioning %s", err, tc.want)
+		}
+	}
+}
+
+func TestMeasuredThresholdLargeWrite(t *testing.T) {
+	payload := []byte(strings.Repeat(hello, 32<<20/len(hello)))
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("{"))
+		w.Write(payload)
+	}), WithMeasuredThreshold())
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	w := &discardWriter{header: make(http.Header)}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	handler.ServeHTTP(w, r)
+	runtime.ReadMemStats(&after)
+	if w.header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("response is not gzipped")
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > uint64(len(payload)/8) {
+		t.Errorf("serving %d bytes allocated %d bytes", len(payload), n)
+	}
+}
+
+func TestAcceptEncodingCache(t *testing.T) {
+	c := NewConfig(WithEncodings("gzip", "deflate"))
+	h := &c.g
+	for i := 0; i < aeCacheSize*2; i++ {
+		hdr := fmt.Sprintf("deflate;q=0.%d, gzip;q=0.5", i%10)
+		if i%2 == 0 {
+			hdr = fmt.Sprintf("x-custom-%d", i)
+		}
+		for j := 0; j < 2; j++ { // second call may be served from cache
+			enc := h.selectEncoding(hdr)
+			var want string
+			switch {
+			case i%2 == 0:
+			case i%10 > 5:
+				want = "deflate"
+			default:
+				want = "gzip"
+			}
+			var got string
+			if enc != nil {
+				got = enc.name
+			}
+			if got != want {
+				t.Fatalf("%q: got %q, want %q", hdr, got, want)
+			}
+		}
+	}
+	var n int
+	h.aeCache.m.Range(func(_, _ interface{}) bool { n++; return true })
+	if n > aeCacheSize {
+		t.Errorf("cache has %d entries, want at most %d", n, aeCacheSize)
+	}
+}
+
+func BenchmarkSelectEncoding(b *testing.B) {
+	const hdr = "gzip, deflate, br"
+	c := NewConfig()
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c.g.selectEncoding(hdr)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		g := c.g
+		g.aeCache = nil
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			g.selectEncoding(hdr)
+		}
+	})
+}
+
+func BenchmarkAllowsGzip(b *testing.B) {
+	for _, hdr := range []string{"gzip, deflate, br", "br;q=1.0, deflate;q=0.8, GZIP;q=0.5"} {
+		b.Run(hdr, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				allowsGzip(hdr)
+			}
+		})
+	}
+}
+
+func FuzzAllowsGzip(f *testing.F) {
+	for _, ex := range allowsGzipExamples {
+		f.Add(ex.hdr)
+	}
+	f.Fuzz(func(t *testing.T, hdr string) {
+		allowsGzip(hdr)
+		if q, ok := codingQuality(hdr, "gzip"); !ok && q != 0 {
+			t.Errorf("%q: got quality %v for unlisted coding", hdr, q)
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	text := []byte(strings.Repeat(hello, compressThreshold/len(hello)+1))
+	f.Add("text/plain", text, 200, "gzip", 100, false)
+	f.Add("", text, 200, "gzip, deflate", 7, true)
+	f.Add("image/png", text, 200, "gzip", 1000, false)
+	f.Add("application/json", text, 404, "deflate", 0, false)
+	f.Add("text/html", []byte(hello), 200, "gzip", 1, true)
+	f.Add("text/plain", text, 204, "gzip", 100, false)
+	f.Add("text/plain", text, 500, "identity", 100, false)
+	handlers := map[bool]http.Handler{}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Context().Value(fuzzKey{}).(fuzzResponse)
+		if body.ct != "" {
+			w.Header().Set("Content-Type", body.ct)
+		}
+		w.WriteHeader(body.code)
+		for b := body.data; len(b) != 0; {
+			n := body.chunk
+			if n <= 0 || n > len(b) {
+				n = len(b)
+			}
+			w.Write(b[:n])
+			b = b[n:]
+		}
+	})
+	for _, measured := range []bool{false, true} {
+		options := []Option{WithEncodings("gzip", "deflate")}
+		if measured {
+			options = append(options, WithMeasuredThreshold())
+		}
+		handlers[measured] = New(inner, options...)
+	}
+	f.Fuzz(func(t *testing.T, ct string, data []byte, code int, ae string, chunk int, measured bool) {
+		if code < 200 || code > 599 {
+			code = http.StatusOK
+		}
+		if strings.ContainsAny(ct, "\r\n") {
+			t.Skip()
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, ae)
+		r = r.WithContext(context.WithValue(r.Context(), fuzzKey{}, fuzzResponse{ct, data, code, chunk}))
+		w := httptest.NewRecorder()
+		handlers[measured].ServeHTTP(w, r)
+		if w.Code != code {
+			t.Fatalf("got status %d, want %d", w.Code, code)
+		}
+		var rd io.Reader = w.Body
+		switch ce := w.Result().Header.Get("Content-Encoding"); ce {
+		case "":
+		case "gzip":
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rd = zr
+		case "deflate":
+			zr, err := zlib.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rd = zr
+		default:
+			t.Fatalf("unexpected Content-Encoding %q", ce)
+		}
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("response body differs from the one written by handler")
+		}
+	})
+}
+
+// fuzzResponse describes response written by handler in FuzzRoundTrip
+type fuzzResponse struct {
+	ct    string
+	data  []byte
+	code  int
+	chunk int
+}
+
+type fuzzKey struct{}
+
+func TestConcurrentRequests(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat(hello, compressThreshold/len(hello)*3)
+	var observed int64
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		for i := 0; i < len(content); i += len(hello) {
+			io.WriteString(w, content[i:i+len(hello)])
+		}
+	}),
+		WithEncodings("gzip", "deflate"),
+		WithLevelByContentType(map[string]int{"text/html": gzip.BestCompression}),
+		WithMeasuredThreshold(),
+		WithMaxConcurrency(8),
+		WithObserver(func(CompressionStats) { atomic.AddInt64(&observed, 1) }),
+	)
+	const workers, requests = 16, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				ct := [...]string{"text/plain", "text/html", "image/png"}[(i+j)%3]
+				ae := [...]string{"gzip", "deflate", "gzip, deflate"}[j%3]
+				r := httptest.NewRequest(http.MethodGet, "/?type="+ct, nil)
+				r.Header.Set(hdrAcceptEncoding, ae)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				var rd io.Reader = w.Body
+				var err error
+				switch w.Result().Header.Get("Content-Encoding") {
+				case "gzip":
+					rd, err = gzip.NewReader(w.Body)
+				case "deflate":
+					rd, err = zlib.NewReader(w.Body)
+				}
+				var b []byte
+				if err == nil {
+					b, err = io.ReadAll(rd)
+				}
+				if err == nil && string(b) != content {
+					err = fmt.Errorf("%s response with Accept-Encoding %q differs from original", ct, ae)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt64(&observed); n != workers*requests {
+		t.Errorf("observer was called %d times, want %d", n, workers*requests)
+	}
+}
+
+func TestWithWriteBufferSize(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)*5)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < len(content); i++ {
+			w.Write([]byte{content[i]})
+			if i == len(content)/2 {
+				w.(http.Flusher).Flush()
+			}
+		}
+	}), WithWriteBufferSize(4096))
+	t.Run("gzipped", testFunc(handler, true, true, content))
+	t.Run("non-gzipped", testFunc(handler, false, false, content))
+}
+
+func BenchmarkSmallWrites(b *testing.B) {
+	data := []byte(`{"key":"value"},`)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i := 0; i < 1000; i++ {
+			w.Write(data)
+		}
+	})
+	bench := func(h http.Handler) func(b *testing.B) {
+		return func(b *testing.B) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(hdrAcceptEncoding, "gzip")
+			w := &discardWriter{header: make(http.Header)}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data) * 1000))
+			for i := 0; i < b.N; i++ {
+				for k := range w.header {
+					delete(w.header, k)
+				}
+				h.ServeHTTP(w, r)
+			}
+		}
+	}
+	b.Run("unbuffered", bench(New(inner)))
+	b.Run("buffered", bench(New(inner, WithWriteBufferSize(4096))))
+}
+
+func TestSetWriteDeadline(t *testing.T) {
+	t.Parallel()
+	deadline := time.Now().Add(time.Minute)
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, content)
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			t.Errorf("SetWriteDeadline: %v", err)
+		}
+		io.WriteString(w, content)
+	}))
+	dw := &deadlineWriter{ResponseRecorder: httptest.NewRecorder()}
+	for _, w := range []http.ResponseWriter{dw, unwrapper{dw}} {
+		dw.deadline = time.Time{}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		handler.ServeHTTP(w, r)
+		if !dw.deadline.Equal(deadline) {
+			t.Errorf("%T: got write deadline %v, want %v", w, dw.deadline, deadline)
+		}
+	}
+}
+
+// deadlineWriter is a http.ResponseWriter that records write deadline
+type deadlineWriter struct {
+	*httptest.ResponseRecorder
+	deadline time.Time
+}
+
+func (w *deadlineWriter) SetWriteDeadline(t time.Time) error {
+	w.deadline = t
+	return nil
+}
+
+// unwrapper is a http.ResponseWriter that only exposes wrapped
+// ResponseWriter via Unwrap method
+type unwrapper struct{ w http.ResponseWriter }
+
+func (u unwrapper) Header() http.Header         { return u.w.Header() }
+func (u unwrapper) Write(b []byte) (int, error) { return u.w.Write(b) }
+func (u unwrapper) WriteHeader(code int)        { u.w.WriteHeader(code) }
+func (u unwrapper) Unwrap() http.ResponseWriter { return u.w }
+
+func TestHeadRequest(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	src := &freshWriters{level: gzip.BestSpeed}
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content))
+	}), WithWriterPool(src))
+	headers := make(map[string]http.Header)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		headers[method] = w.Result().Header
+		if method == http.MethodHead && (src.gets != 1 || w.Body.Len() != 0) {
+			t.Errorf("HEAD request got %d bytes of body, took %d writers from pool", w.Body.Len(), src.gets-1)
+		}
+	}
+	if get, head := headers[http.MethodGet], headers[http.MethodHead]; fmt.Sprint(get) != fmt.Sprint(head) {
+		t.Errorf("HEAD response headers %v differ from GET ones %v", head, get)
+	}
+	if ce := headers[http.MethodHead].Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("HEAD response has Content-Encoding %q, want gzip", ce)
+	}
+	t.Run("measured", func(t *testing.T) {
+		modtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "file.txt", modtime, strings.NewReader(content))
+		}), WithMeasuredThreshold())
+		headers := make(map[string]http.Header)
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			r := httptest.NewRequest(method, "/", nil)
+			r.Header.Set(hdrAcceptEncoding, "gzip")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			headers[method] = w.Result().Header
+		}
+		if get, head := headers[http.MethodGet], headers[http.MethodHead]; fmt.Sprint(get) != fmt.Sprint(head) {
+			t.Errorf("HEAD response headers %v differ from GET ones %v", head, get)
+		}
+		if ce := headers[http.MethodHead].Get("Content-Encoding"); ce != "gzip" {
+			t.Errorf("HEAD response has Content-Encoding %q, want gzip", ce)
+		}
+	})
+}
+
+func TestWithGzipCommentHeader(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		w.Header().Set("X-Gzip-Comment", r.URL.Query().Get("comment"))
+		w.Write([]byte(content))
+	}), WithGzipCommentHeader("x-gzip-comment"))
+	for _, tc := range []struct {
+		ct, comment string
+		wantGzip    bool
+		want        string
+	}{
+		{"text/plain", "export of 2024-01-02", true, "export of 2024-01-02"},
+		{"text/plain", "caf\u00e9", true, "caf\u00e9"},
+		{"text/plain", "\u263a", true, ""},
+		{"image/png", "ignored", false, ""},
+	} {
+		q := url.Values{"ct": {tc.ct}, "comment": {tc.comment}}
+		r := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if v := w.Header().Get("X-Gzip-Comment"); v != "" {
+			t.Errorf("%q: response has X-Gzip-Comment: %s", tc.comment, v)
+		}
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Fatalf("%q: got gzip %v, want %v", tc.comment, got, tc.wantGzip)
+		}
+		if !tc.wantGzip {
+			continue
+		}
+		rd, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.comment, err)
+		}
+		if rd.Comment != tc.want {
+			t.Errorf("got comment %q, want %q", rd.Comment, tc.want)
+		}
+		if data, err := io.ReadAll(rd); err != nil || string(data) != content {
+			t.Errorf("%q: read content differs from served, error: %v", tc.comment, err)
+		}
+	}
+}
+
+func TestWithHintHeader(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		w.Header().Set("Content-Type", q.Get("ct"))
+		if q.Has("hint") {
+			w.Header().Set("X-Compress-Hint", q.Get("hint"))
+		}
+		if q.Has("short") {
+			w.Header().Set("Content-Length", strconv.Itoa(len(hello)))
+			io.WriteString(w, hello)
+			return
+		}
+		io.WriteString(w, content)
+	}), WithHintHeader("x-compress-hint"))
+	for _, tc := range []struct {
+		name, ct, hint string
+		short          bool
+		encoding       string // request Accept-Encoding
+		wantGzip       bool
+	}{
+		{"absent text", "text/plain", "", false, "gzip", true},
+		{"absent image", "image/png", "", false, "gzip", false},
+		{"no", "text/plain", "no", false, "gzip", false},
+		{"no uppercase", "text/plain", "NO", false, "gzip", false},
+		{"yes", "image/png", "yes", false, "gzip", true},
+		{"yes uppercase", "image/png", " Yes ", false, "gzip", true},
+		{"yes below threshold", "image/png", "yes", true, "gzip", false},
+		{"unknown", "image/png", "maybe", false, "gzip", false},
+		{"not accepted", "text/plain", "yes", false, "identity", false},
+	} {
+		q := url.Values{"ct": {tc.ct}}
+		if tc.hint != "" {
+			q.Set("hint", tc.hint)
+		}
+		if tc.short {
+			q.Set("short", "1")
+		}
+		r := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+		r.Header.Set(hdrAcceptEncoding, tc.encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if v, ok := w.Header()["X-Compress-Hint"]; ok {
+			t.Errorf("%s: response has X-Compress-Hint: %q", tc.name, v)
+		}
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+		}
+	}
+}
+
+func TestWithContentLengthPolicy(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)*2)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		io.WriteString(w, content)
+	})
+	for _, tc := range []struct {
+		name     string
+		h        http.Handler
+		preserve bool
+	}{
+		{"default", New(inner, WithBufferHighWater(len(content)*2)), false},
+		{"buffered", New(inner, WithBufferHighWater(len(content)*2), WithContentLengthPolicy(PreserveIfBuffered)), true},
+		{"streamed", New(inner, WithContentLengthPolicy(PreserveIfBuffered)), false},
+	} {
+		w := serve(tc.h, "gzip")
+		if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("%s: got Content-Encoding %q, want gzip", tc.name, ce)
+		}
+		cl := w.Header().Get("Content-Length")
+		switch {
+		case tc.preserve && cl != strconv.Itoa(w.Body.Len()):
+			t.Errorf("%s: got Content-Length %q, want %d", tc.name, cl, w.Body.Len())
+		case !tc.preserve && cl != "":
+			t.Errorf("%s: got Content-Length %q, want none", tc.name, cl)
+		}
+		if data, err := readAllGzipped(w.Body); err != nil || string(data) != content {
+			t.Errorf("%s: read content differs from served, error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestWithHeadPrecompute(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 10; i++ {
+			io.WriteString(w, content)
+		}
+	}), WithHeadPrecompute())
+	responses := make(map[string]*httptest.ResponseRecorder)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		responses[method] = w
+	}
+	get, head := responses[http.MethodGet], responses[http.MethodHead]
+	if get.Header().Get("Content-Encoding") != "gzip" || head.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("response is not compressed")
+	}
+	if got, want := head.Header().Get("Content-Length"), strconv.Itoa(get.Body.Len()); got != want {
+		t.Errorf("HEAD response has Content-Length %q, want %q", got, want)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD response has %d bytes of body", head.Body.Len())
+	}
+	if data, err := readAllGzipped(get.Body); err != nil || string(data) != strings.Repeat(content, 10) {
+		t.Fatalf("read content differs from served, error: %v", err)
+	}
+	t.Run("no body", func(t *testing.T) {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(content))
+		})
+		r := httptest.NewRequest(http.MethodHead, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		New(inner, WithHeadPrecompute()).ServeHTTP(w, r)
+		ce, cl := w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length")
+		if ce != "gzip" || cl != "" {
+			t.Errorf("got Content-Encoding %q, Content-Length %q; want gzip and none", ce, cl)
+		}
+	})
+}
+
+func TestNewRouter(t *testing.T) {
+	t.Parallel()
+	handler := NewRouter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", r.URL.Query().Get("size"))
+		n, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Write([]byte(strings.Repeat("x", n)))
+	}), map[string]*Config{
+		"/api/":       NewConfig(WithThreshold(100)),
+		"/api/export": NewConfig(WithThreshold(10000), WithLevel(gzip.BestCompression)),
+		"/static/":    NewConfig(WithThreshold(10)),
+		"/raw/":       nil,
+	}, NewConfig())
+	for _, tc := range []struct {
+		url      string
+		wantGzip bool
+	}{
+		{"/api/users?size=500", true},
+		{"/api/users?size=50", false},
+		{"/api/export?size=5000", false},
+		{"/api/export/all?size=500", true}, // not an exact match for /api/export
+		{"/static/app.css?size=50", true},
+		{"/raw/data.txt?size=5000", false},
+		{"/other?size=500", false},
+		{"/other?size=5000", true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Result().Header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.url, got, tc.wantGzip)
+		}
+	}
+	passThrough := NewRouter(http.NotFoundHandler(), nil, nil)
+	if w := serve(passThrough, "gzip"); w.Result().Header.Get("Vary") != "" {
+		t.Error("handler without fallback configuration modified response")
+	}
+}
+
+func TestNilResponseWriter(t *testing.T) {
+	defer func() {
+		if p := recover(); p != nil {
+			t.Fatalf("panic: %v", p)
+		}
+	}()
+	c := NewConfig()
+	g := &gRW{h: &c.g, enc: &c.g.encodings[0]}
+	g.init([]byte(hello))
+	if !g.skip || g.z != nil {
+		t.Error("compression is set up for nil ResponseWriter")
+	}
+	var called bool
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(hdrAcceptEncoding, "gzip")
+	h.ServeHTTP(nil, r)
+	if !called {
+		t.Error("wrapped handler was not called")
+	}
+}
+
+func TestWithInitialFlush(t *testing.T) {
+	t.Parallel()
+	for _, initial := range []bool{false, true} {
+		var options []Option
+		if initial {
+			options = append(options, WithInitialFlush())
+		}
+		rec := httptest.NewRecorder()
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: 1\n\n")
+			if rec.Flushed != initial {
+				t.Errorf("initial flush %v: response flushed: %v", initial, rec.Flushed)
+			}
+			if initial && rec.Body.Len() == 0 {
+				t.Error("no bytes were flushed")
+			}
+		}), options...)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		handler.ServeHTTP(rec, r)
+		if b, err := readAllGzipped(rec.Body); err != nil || string(b) != "data: 1\n\n" {
+			t.Errorf("initial flush %v: decompressed content differs from original, error: %v", initial, err)
+		}
+	}
+}
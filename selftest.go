@@ -0,0 +1,114 @@
+package httpgzip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SelfTest checks that handler configured with the given options compresses
+// responses of compressible content type with each of the configured
+// content-codings so that they decompress to the original content, and passes
+// responses of non-compressible content type as is. Compressible content type
+// is picked from the configured ones, sampling set with WithSampleRate is
+// ignored. It is meant to be called on program startup to detect
+// misconfiguration early.
+func SelfTest(options ...Option) error {
+	c := NewConfig(options...)
+	c.g.sampleRate = 1
+	probe := c.g.probeType()
+	if probe == "" {
+		return errors.New("httpgzip: no compressible content type is configured")
+	}
+	payload := []byte(strings.Repeat("httpgzip self-test payload\n", c.g.threshold/10+1))
+	var roundTrips int
+	for _, ct := range []string{probe, "application/octet-stream"} {
+		compressible := c.g.compressible(ct)
+		h := NewWithConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, ct)
+			w.Write(payload)
+		}), c)
+		for i, cd := range c.g.codings {
+			token := c.g.encodings[i].token
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				return err
+			}
+			r.Header.Set(hdrAcceptEncoding, cd.name)
+			w := &recorder{header: make(http.Header)}
+			h.ServeHTTP(w, r)
+			ce := w.header.Get(hdrContentEncoding)
+			var body io.ReadCloser = io.NopCloser(&w.body)
+			switch {
+			case compressible && ce != token:
+				return fmt.Errorf("httpgzip: %s response with Accept-Encoding: %s has Content-Encoding %q, want %q",
+					ct, cd.name, ce, token)
+			case !compressible && ce != "":
+				return fmt.Errorf("httpgzip: %s response with Accept-Encoding: %s has Content-Encoding %q, want none",
+					ct, cd.name, ce)
+			case compressible:
+				rd, err := cd.newReader(&w.body)
+				if err != nil {
+					return fmt.Errorf("httpgzip: decoding %s response body: %w", cd.name, err)
+				}
+				body = rd
+				roundTrips++
+			}
+			data, err := io.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return fmt.Errorf("httpgzip: decoding %s response body: %w", cd.name, err)
+			}
+			if !bytes.Equal(data, payload) {
+				return fmt.Errorf("httpgzip: %s response body with Accept-Encoding: %s differs from original",
+					ct, cd.name)
+			}
+		}
+	}
+	if roundTrips == 0 {
+		return errors.New("httpgzip: no compressed response was checked")
+	}
+	return nil
+}
+
+// probeType returns compressible content type to check configuration with,
+// derived from configured content types, or empty string if there's none.
+func (h *gzipHandler) probeType() string {
+	list := h.exactTypes
+	if list == nil {
+		list = h.contentTypes
+	}
+	if list == nil {
+		list = DefaultContentTypes()
+	}
+	candidates := []string{"text/plain; charset=utf-8"}
+	for _, s := range list {
+		switch {
+		case strings.HasPrefix(s, "+"):
+			s = "application/self-test" + s
+		case strings.HasSuffix(s, "/"):
+			s += "plain"
+		}
+		candidates = append(candidates, s)
+	}
+	for _, ct := range candidates {
+		if h.compressible(ct) {
+			return ct
+		}
+	}
+	return ""
+}
+
+// recorder is a minimal http.ResponseWriter keeping response body in memory,
+// so that SelfTest does not need net/http/httptest linked into programs.
+type recorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *recorder) Header() http.Header         { return w.header }
+func (w *recorder) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *recorder) WriteHeader(int)             {}
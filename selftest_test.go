@@ -0,0 +1,33 @@
+package httpgzip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SelfTest(WithEncodings("deflate", "gzip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SelfTest(WithContentEncodingToken("x-gzip")); err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []Option{
+		WithExactContentTypes("application/json"),
+		WithContentTypes("application/json"),
+		WithContentTypes("+json"),
+		WithSampleRate(0),
+	} {
+		if err := SelfTest(opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SelfTest(WithPredicate(func(*http.Request) bool { return false })); err == nil {
+		t.Fatal("SelfTest succeeded for handler that never compresses")
+	} else {
+		t.Log(err)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build go1.22
+
+package httpgzip
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestServeFileFS(t *testing.T) {
+	t.Parallel()
+	jsonBody := `{"items":[` + strings.Repeat(`"`+hello+`",`, compressThreshold/len(hello)*4) + `""]}`
+	wasm := append([]byte("\x00asm\x01\x00\x00\x00"), bytes.Repeat([]byte{1, 2, 3, 4}, compressThreshold)...)
+	fsys := fstest.MapFS{
+		"data.json":   {Data: []byte(jsonBody)},
+		"module.wasm": {Data: wasm},
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, fsys, strings.TrimPrefix(r.URL.Path, "/"))
+	})
+	withWasm := WithContentTypes(append(DefaultContentTypes(), "application/wasm")...)
+	for _, tc := range []struct {
+		name, path string
+		h          http.Handler
+		wantGzip   bool
+		want       string
+	}{
+		{"json", "/data.json", New(inner), true, jsonBody},
+		{"wasm", "/module.wasm", New(inner), false, string(wasm)},
+		{"wasm enabled", "/module.wasm", New(inner, withWasm), true, string(wasm)},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set(hdrAcceptEncoding, "gzip")
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", tc.name, w.Code)
+		}
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Fatalf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+		}
+		body := w.Body.Bytes()
+		cl := w.Header().Get("Content-Length")
+		if tc.wantGzip {
+			if cl != "" {
+				t.Errorf("%s: compressed response has Content-Length %s", tc.name, cl)
+			}
+			var err error
+			if body, err = readAllGzipped(w.Body); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		} else if cl != strconv.Itoa(len(tc.want)) {
+			t.Errorf("%s: got Content-Length %q, want %d", tc.name, cl, len(tc.want))
+		}
+		if string(body) != tc.want {
+			t.Errorf("%s: response body differs from original", tc.name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+"use strict";
+
+function handler0(event) {
+	console.log("event 0", event.type);
+}
+
+function handler1(event) {
+	console.log("event 1", event.type);
+}
+
+function handler2(event) {
+	console.log("event 2", event.type);
+}
+
+function handler3(event) {
+	console.log("event 3", event.type);
+}
+
+function handler4(event) {
+	console.log("event 4", event.type);
+}
+
+function handler5(event) {
+	console.log("event 5", event.type);
+}
+
+function handler6(event) {
+	console.log("event 6", event.type);
+}
+
+function handler7(event) {
+	console.log("event 7", event.type);
+}
+
+function handler8(event) {
+	console.log("event 8", event.type);
+}
+
+function handler9(event) {
+	console.log("event 9", event.type);
+}
+
+function handler10(event) {
+	console.log("event 10", event.type);
+}
+
+function handler11(event) {
+	console.log("event 11", event.type);
+}
+
+function handler12(event) {
+	console.log("event 12", event.type);
+}
+
+function handler13(event) {
+	console.log("event 13", event.type);
+}
+
+function handler14(event) {
+	console.log("event 14", event.type);
+}
+
+function handler15(event) {
+	console.log("event 15", event.type);
+}
+
+function handler16(event) {
+	console.log("event 16", event.type);
+}
+
+function handler17(event) {
+	console.log("event 17", event.type);
+}
+
+function handler18(event) {
+	console.log("event 18", event.type);
+}
+
+function handler19(event) {
+	console.log("event 19", event.type);
+}
+
+function handler20(event) {
+	console.log("event 20", event.type);
+}
+
+function handler21(event) {
+	console.log("event 21", event.type);
+}
+
+function handler22(event) {
+	console.log("event 22", event.type);
+}
+
+function handler23(event) {
+	console.log("event 23", event.type);
+}
+
+function handler24(event) {
+	console.log("event 24", event.type);
+}
+
+function handler25(event) {
+	console.log("event 25", event.type);
+}
+
+function handler26(event) {
+	console.log("event 26", event.type);
+}
+
+function handler27(event) {
+	console.log("event 27", event.type);
+}
+
+function handler28(event) {
+	console.log("event 28", event.type);
+}
+
+function handler29(event) {
+	console.log("event 29", event.type);
+}
+
@@ -0,0 +1,56 @@
+package httpgzip
+
+import (
+	"io"
+	"net/http"
+)
+
+// HeaderWriter is a byte stream preceded by HTTP-like header fields, like the
+// ones used by RPC framers. Header fields must be sent along with the first
+// Write call, modifying them afterwards has no effect. Header must return the
+// same map on each call.
+type HeaderWriter interface {
+	io.Writer
+	Header() http.Header
+}
+
+// Writer compresses data written to it the same way handler created with
+// NewWithConfig compresses response body, but outside of HTTP: it decides
+// whether to compress based on Content-Type and Content-Length header fields
+// and the size and content of data, and if it does, it sets Content-Encoding
+// header field and removes Content-Length. Data is compressed with the first
+// content-coding configured, there is no negotiation.
+type Writer struct {
+	g *gRW
+}
+
+// NewWriter returns Writer compressing data written to w, configured by c. If
+// c is nil, default configuration is used, with level set by SetDefaultLevel.
+// Options depending on HTTP request, like WithReflectionGuard or
+// WithExtensionDetection, have no effect.
+func NewWriter(w HeaderWriter, c *Config) *Writer {
+	if c == nil {
+		c = baseConfig()
+	}
+	g := &gRW{w: headerWriter{w}, h: &c.g, enc: &c.g.encodings[0]}
+	g.state = &requestState{}
+	return &Writer{g: g}
+}
+
+// Write writes data, compressing it if needed. Header fields of the
+// underlying HeaderWriter must be set before the first call to Write.
+func (w *Writer) Write(b []byte) (int, error) { return w.g.Write(b) }
+
+// Close writes any buffered data and finalizes compressed stream, it does not
+// close the underlying HeaderWriter. Writes after Close return
+// ErrWriteAfterClose.
+func (w *Writer) Close() error {
+	w.g.close()
+	return w.g.state.err
+}
+
+// headerWriter adapts HeaderWriter to http.ResponseWriter, ignoring status
+// codes.
+type headerWriter struct{ HeaderWriter }
+
+func (headerWriter) WriteHeader(int) {}
@@ -0,0 +1,83 @@
+package httpgzip
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// frame is a HeaderWriter that records header fields as of the first Write,
+// like a framer sending them ahead of the payload would.
+type frame struct {
+	header http.Header
+	sent   http.Header
+	bytes.Buffer
+}
+
+func (f *frame) Header() http.Header { return f.header }
+
+func (f *frame) Write(b []byte) (int, error) {
+	if f.sent == nil {
+		f.sent = f.header.Clone()
+	}
+	return f.Buffer.Write(b)
+}
+
+func TestWriter(t *testing.T) {
+	content := strings.Repeat(hello, compressThreshold/len(hello)+1)
+	for _, tc := range []struct {
+		name     string
+		header   http.Header
+		content  string
+		wantGzip bool
+	}{
+		{"text", http.Header{"Content-Type": {"text/plain"}}, content, true},
+		{"sniffed", http.Header{}, content, true},
+		{"binary", http.Header{"Content-Type": {"image/png"}}, content, false},
+		{"small", http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"14"}}, hello, false},
+	} {
+		f := &frame{header: tc.header}
+		w := NewWriter(f, NewConfig(WithMeasuredThreshold()))
+		for s := tc.content; s != ""; {
+			n := 100
+			if n > len(s) {
+				n = len(s)
+			}
+			if _, err := w.Write([]byte(s[:n])); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			s = s[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if _, err := w.Write([]byte(hello)); err != ErrWriteAfterClose {
+			t.Errorf("%s: write after close got error %v, want %v", tc.name, err, ErrWriteAfterClose)
+		}
+		if got := f.sent.Get(hdrContentEncoding) == "gzip"; got != tc.wantGzip {
+			t.Fatalf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+		}
+		data := f.Bytes()
+		if tc.wantGzip {
+			if f.sent.Get(hdrContentLength) != "" {
+				t.Errorf("%s: compressed stream has Content-Length", tc.name)
+			}
+			var err error
+			if data, err = readAllGzipped(&f.Buffer); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+		if string(data) != tc.content {
+			t.Errorf("%s: data differs from written", tc.name)
+		}
+	}
+	f := &frame{header: http.Header{"Content-Length": {strconv.Itoa(len(content))}}}
+	w := NewWriter(f, nil)
+	w.Write([]byte(content))
+	w.Close()
+	if f.sent.Get(hdrContentEncoding) != "gzip" || f.Len() >= len(content) {
+		t.Error("writer with default configuration did not compress data")
+	}
+}